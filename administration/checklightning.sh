@@ -0,0 +1,6 @@
+#!/bin/bash
+pidof  checklightning >/dev/null
+if [[ $? -ne 0 ]] ; then
+        echo "Checking Lightning invoices: $(date)" >> /var/log/checklightning.log
+        /usr/local/bin/checklightning "postgres://<USERNAME>:<PASSWORD>@127.0.0.1/<DB_NAME>?sslmode=disable" &> /var/log/checklightning.log &
+fi
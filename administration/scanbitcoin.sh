@@ -0,0 +1,6 @@
+#!/bin/bash
+pidof  scanbitcoin >/dev/null
+if [[ $? -ne 0 ]] ; then
+        echo "Scanning Bitcoin:           $(date)" >> /var/log/scanbitcoin.log
+        /usr/local/bin/scanbitcoin "postgres://<USERNAME>:<PASSWORD>@127.0.0.1/<DB_NAME>?sslmode=disable" "https://blockstream.info/api" &> /var/log/scanbitcoin.log &
+fi
@@ -0,0 +1,6 @@
+#!/bin/bash
+pidof  scanmonero >/dev/null
+if [[ $? -ne 0 ]] ; then
+        echo "Scanning Monero blocks:     $(date)" >> /var/log/scanmonero.log
+        /usr/local/bin/scanmonero "postgres://<USERNAME>:<PASSWORD>@127.0.0.1/<DB_NAME>?sslmode=disable" "http://127.0.0.1:18081" &> /var/log/scanmonero.log &
+fi
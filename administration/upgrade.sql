@@ -0,0 +1,102 @@
+-- Statements to bring an existing database up to date with schema.sql,
+-- run the ones added since your last upgrade, in order.
+
+-- payments.amount holds atomic units (piconero) instead of rounded XMR
+ALTER TABLE payments ALTER COLUMN amount TYPE bigint USING round(amount * 1000000000000);
+
+-- a transaction counts once per accepted payment, drop duplicates from earlier rescans
+DELETE FROM payments a USING payments b
+WHERE a.id > b.id AND a.accepted_payments_id = b.accepted_payments_id AND a.tx_id = b.tx_id;
+ALTER TABLE payments ADD CONSTRAINT payments_accepted_payments_id_tx_id_key UNIQUE (accepted_payments_id, tx_id);
+
+-- transactions that did not count as votes, and why
+CREATE TABLE rejected_payments (
+                                 id serial PRIMARY KEY,
+                                 address varchar NOT NULL,
+                                 tx_id varchar NOT NULL,
+                                 tx_date timestamp NOT NULL,
+                                 amount bigint NOT NULL,
+                                 reason varchar NOT NULL,
+                                 accepted_payments_id INTEGER NOT NULL references accepted_payments(id),
+                                 UNIQUE (accepted_payments_id, tx_id)
+);
+
+-- block heights of payments, for reorg checks, and votes still waiting for confirmations
+ALTER TABLE payments ADD COLUMN height INTEGER;
+CREATE TABLE pending_payments (
+                                 id serial PRIMARY KEY,
+                                 address varchar NOT NULL,
+                                 tx_id varchar NOT NULL,
+                                 tx_date timestamp NOT NULL,
+                                 amount bigint NOT NULL,
+                                 height INTEGER, -- NULL while in the mempool
+                                 accepted_payments_id INTEGER NOT NULL references accepted_payments(id),
+                                 UNIQUE (accepted_payments_id, tx_id)
+);
+
+-- votes for single entries, paid to an address published with the entry
+ALTER TABLE entries ADD COLUMN pay_address varchar;
+ALTER TABLE payments ADD COLUMN entry_id INTEGER references entries(id);
+ALTER TABLE pending_payments ADD COLUMN entry_id INTEGER references entries(id);
+
+-- invoices issued to Lightning voters, settled ones are also recorded in payments
+CREATE TABLE lightning_invoices (
+                                 id serial PRIMARY KEY,
+                                 payment_hash varchar NOT NULL UNIQUE,
+                                 invoice varchar NOT NULL,
+                                 amount bigint NOT NULL, -- satoshi
+                                 verify_url varchar NOT NULL, -- LUD-21, empty if the author's server has none
+                                 created timestamp NOT NULL,
+                                 expires timestamp NOT NULL,
+                                 settled timestamp,
+                                 feed_id INTEGER NOT NULL references feeds(id),
+                                 accepted_payments_id INTEGER NOT NULL references accepted_payments(id)
+);
+
+-- dated rates to compare votes in different currencies, see importprices
+CREATE TABLE prices (
+                     id serial PRIMARY KEY,
+                     ticker varchar NOT NULL,
+                     date date NOT NULL,
+                     price numeric NOT NULL, -- one whole coin in the reference currency
+                     UNIQUE (ticker, date)
+);
+
+-- sync status of every account, shown on the feed pages
+ALTER TABLE accepted_payments ADD COLUMN scanned_block_height bigint;
+ALTER TABLE accepted_payments ADD COLUMN blockchain_height bigint;
+ALTER TABLE accepted_payments ADD COLUMN synced timestamp;
+
+-- authors prove they control a feed before registering view keys privately,
+-- addresses without one are now kept
+CREATE TABLE feed_claims (
+                            id serial PRIMARY KEY,
+                            user_id INTEGER NOT NULL references users(id),
+                            feed_id INTEGER NOT NULL references feeds(id),
+                            token varchar NOT NULL UNIQUE,
+                            created timestamp NOT NULL,
+                            verified timestamp, -- NULL until the token was found in the feed
+                            UNIQUE (user_id, feed_id)
+);
+UPDATE accepted_payments SET view_key = NULL WHERE view_key = '';
+
+-- authors manage their claimed feeds
+ALTER TABLE accepted_payments ADD COLUMN retired timestamp;
+ALTER TABLE feeds ADD COLUMN delisted BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE entries ADD COLUMN hidden BOOLEAN NOT NULL DEFAULT false;
+
+-- votes within a time window, /top/day to /top/year
+CREATE INDEX payments_tx_date_idx ON payments (tx_date);
+
+-- payment methods dropped from a feed are retired when it's resubmitted,
+-- unless the author added them by hand
+ALTER TABLE accepted_payments ADD COLUMN manual BOOLEAN NOT NULL DEFAULT false;
+
+-- only authors whose view key was checked to open the address are matched
+-- by it, viewkeys reseal checks those stored before
+ALTER TABLE accepted_payments ADD COLUMN view_key_checked BOOLEAN NOT NULL DEFAULT false;
+
+-- paid Lightning invoices are unverified votes, the author's own server
+-- reports them, they no longer count as payments
+DELETE FROM payments p USING lightning_invoices i
+WHERE p.accepted_payments_id = i.accepted_payments_id AND p.tx_id = i.payment_hash;
@@ -0,0 +1,156 @@
+package bitcoin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Esplora talks to the HTTP API of an Esplora or Electrs server, such as
+// https://blockstream.info/api
+type Esplora struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewEsplora(rawurl string) (*Esplora, error) {
+	if _, err := url.ParseRequestURI(rawurl); err != nil {
+		return nil, err
+	}
+	return &Esplora{
+		URL: rawurl,
+		Client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}, nil
+}
+
+type Output struct {
+	Address string `json:"scriptpubkey_address"`
+	Value   uint64 `json:"value"` // satoshi
+}
+
+type Input struct {
+	TxID     string  `json:"txid"`
+	Vout     uint32  `json:"vout"`
+	Prevout  *Output `json:"prevout"` // nil for coinbase inputs
+	Coinbase bool    `json:"is_coinbase"`
+}
+
+type Transaction struct {
+	TxID     string   `json:"txid"`
+	Locktime uint32   `json:"locktime"`
+	Vin      []Input  `json:"vin"`
+	Vout     []Output `json:"vout"`
+	Status   struct {
+		Confirmed   bool   `json:"confirmed"`
+		BlockHeight uint64 `json:"block_height"`
+		BlockTime   int64  `json:"block_time"`
+	} `json:"status"`
+}
+
+func (t *Transaction) Coinbase() bool {
+	return len(t.Vin) > 0 && t.Vin[0].Coinbase
+}
+
+func (e *Esplora) get(ctx context.Context, path string) ([]byte, error) {
+	u, err := url.ParseRequestURI(e.URL)
+	if err != nil {
+		return nil, err
+	}
+	// the API usually lives below a path, e.g. /api
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("User-Agent", "gemmit (https://github.com/t-900-a/gemmit)")
+
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("Unexpected Esplora response %s for %s", resp.Status, path)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 67108864)) // 64 MiB
+}
+
+func (e *Esplora) getJSON(ctx context.Context, path string, out interface{}) error {
+	body, err := e.get(ctx, path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, out)
+}
+
+// Height returns the height of the chain tip
+func (e *Esplora) Height(ctx context.Context) (uint64, error) {
+	body, err := e.get(ctx, "/blocks/tip/height")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(body)), 10, 64)
+}
+
+// Used tells if an address appears in any transaction, confirmed or not
+func (e *Esplora) Used(ctx context.Context, address string) (bool, error) {
+	type stats struct {
+		TxCount int `json:"tx_count"`
+	}
+	var info struct {
+		ChainStats   stats `json:"chain_stats"`
+		MempoolStats stats `json:"mempool_stats"`
+	}
+	if err := e.getJSON(ctx, "/address/"+url.PathEscape(address), &info); err != nil {
+		return false, err
+	}
+	return info.ChainStats.TxCount+info.MempoolStats.TxCount > 0, nil
+}
+
+// Transactions returns the mempool transactions of an address along with
+// its confirmed transactions above height, newest first
+func (e *Esplora) Transactions(ctx context.Context, address string, height uint64) ([]*Transaction, error) {
+	path := "/address/" + url.PathEscape(address) + "/txs"
+	var txs []*Transaction
+	// the first page has the mempool and the newest confirmed transactions,
+	// later pages continue after the last confirmed one seen
+	if err := e.getJSON(ctx, path, &txs); err != nil {
+		return nil, err
+	}
+	page := txs
+	for {
+		var last *Transaction
+		for _, t := range page {
+			if t.Status.Confirmed {
+				last = t
+			}
+		}
+		if last == nil || last.Status.BlockHeight <= height {
+			break
+		}
+		page = nil
+		if err := e.getJSON(ctx, path+"/chain/"+last.TxID, &page); err != nil {
+			return nil, err
+		}
+		if len(page) == 0 {
+			break
+		}
+		txs = append(txs, page...)
+	}
+
+	result := txs[:0]
+	for _, t := range txs {
+		if !t.Status.Confirmed || t.Status.BlockHeight > height {
+			result = append(result, t)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,113 @@
+package bitcoin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// esploraStub serves the transactions of one address the way Esplora pages
+// them: the mempool and 25 confirmed transactions first, then 25 at a time
+// after the last one seen
+type esploraStub struct {
+	address   string
+	mempool   []*Transaction
+	confirmed []*Transaction // newest first
+	requests  []string
+}
+
+func (s *esploraStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.requests = append(s.requests, r.URL.Path)
+	prefix := "/api/address/" + s.address + "/txs"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	var page []*Transaction
+	switch rest := strings.TrimPrefix(r.URL.Path, prefix); {
+	case rest == "":
+		page = append(page, s.mempool...)
+		page = append(page, s.confirmed[:min(25, len(s.confirmed))]...)
+	case strings.HasPrefix(rest, "/chain/"):
+		after := strings.TrimPrefix(rest, "/chain/")
+		for i, t := range s.confirmed {
+			if t.TxID == after {
+				rest := s.confirmed[i+1:]
+				page = rest[:min(25, len(rest))]
+			}
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func TestTransactionsPaging(t *testing.T) {
+	stub := &esploraStub{address: "bc1qstub"}
+	for i := 0; i < 2; i++ {
+		stub.mempool = append(stub.mempool, &Transaction{TxID: fmt.Sprintf("mempool%d", i)})
+	}
+	// two transactions in every block from 170 down to 101
+	for height := uint64(170); height > 100; height-- {
+		for i := 0; i < 2; i++ {
+			tx := &Transaction{TxID: fmt.Sprintf("tx%d-%d", height, i)}
+			tx.Status.Confirmed = true
+			tx.Status.BlockHeight = height
+			stub.confirmed = append(stub.confirmed, tx)
+		}
+	}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	e, err := NewEsplora(srv.URL + "/api/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txs, err := e.Transactions(context.Background(), stub.address, 140)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the mempool and blocks 141 to 170
+	if len(txs) != 2+60 {
+		t.Fatalf("got %d transactions, want %d", len(txs), 62)
+	}
+	seen := make(map[string]bool)
+	for _, tx := range txs {
+		if seen[tx.TxID] {
+			t.Errorf("%s returned twice", tx.TxID)
+		}
+		seen[tx.TxID] = true
+		if tx.Status.Confirmed && tx.Status.BlockHeight <= 140 {
+			t.Errorf("%s at height %d is not above 140", tx.TxID, tx.Status.BlockHeight)
+		}
+	}
+	// the third page reaches block 140, there's no need for a fourth
+	if len(stub.requests) != 3 {
+		t.Errorf("got %d requests, want 3: %v", len(stub.requests), stub.requests)
+	}
+
+	// everything from the start
+	stub.requests = nil
+	txs, err = e.Transactions(context.Background(), stub.address, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 2+140 {
+		t.Errorf("got %d transactions from the start, want %d", len(txs), 142)
+	}
+	if len(stub.requests) != 7 {
+		t.Errorf("got %d requests from the start, want 7: %v", len(stub.requests), stub.requests)
+	}
+}
@@ -0,0 +1,139 @@
+package bitcoin
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/base58"
+	"github.com/btcsuite/btcutil/hdkeychain"
+)
+
+var ErrInvalidWallet = errors.New("Not a Bitcoin address or extended public key")
+
+type scriptType int
+
+const (
+	p2pkh      scriptType = iota // BIP44, 1...
+	p2shP2wpkh                   // BIP49, 3...
+	p2wpkh                       // BIP84, bc1q...
+)
+
+// extended public key versions, SLIP-0132
+var versions = []struct {
+	version []byte
+	params  *chaincfg.Params
+	script  scriptType
+}{
+	{[]byte{0x04, 0x88, 0xb2, 0x1e}, &chaincfg.MainNetParams, p2pkh},       // xpub
+	{[]byte{0x04, 0x9d, 0x7c, 0xb2}, &chaincfg.MainNetParams, p2shP2wpkh},  // ypub
+	{[]byte{0x04, 0xb2, 0x47, 0x46}, &chaincfg.MainNetParams, p2wpkh},      // zpub
+	{[]byte{0x04, 0x35, 0x87, 0xcf}, &chaincfg.TestNet3Params, p2pkh},      // tpub
+	{[]byte{0x04, 0x4a, 0x52, 0x62}, &chaincfg.TestNet3Params, p2shP2wpkh}, // upub
+	{[]byte{0x04, 0x5f, 0x1c, 0xf6}, &chaincfg.TestNet3Params, p2wpkh},     // vpub
+}
+
+// Chains of a BIP32 account, votes arrive on the external chain but change
+// on the internal one is needed to tell what a transaction sent
+const (
+	External uint32 = 0
+	Internal uint32 = 1
+)
+
+// Wallet is what an author publishes to receive votes, either a single
+// address or the extended public key of an account whose addresses are
+// derived as they get used
+type Wallet struct {
+	Address string // empty for extended keys
+	key     *hdkeychain.ExtendedKey
+	script  scriptType
+	params  *chaincfg.Params
+}
+
+// ParseWallet decodes an address or account extended public key (xpub,
+// ypub or zpub, or their testnet versions) belonging to params
+func ParseWallet(s string, params *chaincfg.Params) (*Wallet, error) {
+	if key, err := hdkeychain.NewKeyFromString(s); err == nil {
+		if key.IsPrivate() {
+			return nil, errors.New("Extended key is private, publish the extended public key instead")
+		}
+		// the key doesn't expose its version, NewKeyFromString checked the
+		// length and checksum already
+		version := base58.Decode(s)[:4]
+		for _, v := range versions {
+			if !bytes.Equal(version, v.version) {
+				continue
+			}
+			if v.params != params {
+				return nil, errors.New("Extended public key is not for " + params.Name)
+			}
+			return &Wallet{key: key, script: v.script, params: params}, nil
+		}
+		return nil, ErrInvalidWallet
+	}
+
+	addr, err := btcutil.DecodeAddress(s, params)
+	if err != nil {
+		return nil, ErrInvalidWallet
+	}
+	if !addr.IsForNet(params) {
+		return nil, errors.New("Bitcoin address is not for " + params.Name)
+	}
+	switch addr.(type) {
+	case *btcutil.AddressPubKey:
+		// a bare public key decodes as well, but isn't an address
+		return nil, ErrInvalidWallet
+	}
+	return &Wallet{Address: addr.EncodeAddress(), params: params}, nil
+}
+
+// Extended tells if addresses have to be derived
+func (w *Wallet) Extended() bool {
+	return w.key != nil
+}
+
+// Derive returns the address at index of chain, External or Internal
+func (w *Wallet) Derive(chain, index uint32) (string, error) {
+	if w.key == nil {
+		return "", errors.New("Not an extended public key")
+	}
+	branch, err := w.key.Child(chain)
+	if err != nil {
+		return "", err
+	}
+	child, err := branch.Child(index)
+	if err != nil {
+		return "", err
+	}
+	pub, err := child.ECPubKey()
+	if err != nil {
+		return "", err
+	}
+	hash := btcutil.Hash160(pub.SerializeCompressed())
+
+	var addr btcutil.Address
+	switch w.script {
+	case p2pkh:
+		addr, err = btcutil.NewAddressPubKeyHash(hash, w.params)
+	case p2shP2wpkh:
+		// the redeem script is a version 0 witness program
+		addr, err = btcutil.NewAddressScriptHash(append([]byte{0x00, 0x14}, hash...), w.params)
+	case p2wpkh:
+		addr, err = btcutil.NewAddressWitnessPubKeyHash(hash, w.params)
+	}
+	if err != nil {
+		return "", err
+	}
+	return addr.EncodeAddress(), nil
+}
+
+// StripURI returns the address of a bitcoin: URI, or s as is
+func StripURI(s string) string {
+	s = strings.TrimPrefix(s, "bitcoin:")
+	if i := strings.Index(s, "?"); i >= 0 {
+		s = s[:i]
+	}
+	return s
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/t-900-a/gemmit/cryptonote"
+	"github.com/t-900-a/gemmit/feeds"
+
+	"git.sr.ht/~adnano/go-gemini"
+)
+
+// Claim is a user's claim to be the author of a feed. It is proven by
+// putting the token into the feed, which only its author can do.
+type Claim struct {
+	FeedID    int
+	FeedTitle string
+	FeedURL   string
+	Token     string
+	Verified  *time.Time
+	// Revoked is how many claims of other users were just revoked
+	Revoked int64
+}
+
+func newClaimToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "gemmit-claim-" + hex.EncodeToString(b), nil
+}
+
+// loadClaim looks up a user's claim to a feed, starting one if there is
+// none. Claims are bound to the user's client certificate.
+func loadClaim(ctx context.Context, tx *sql.Tx, userID, feedID int) (*Claim, error) {
+	token, err := newClaimToken()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO feed_claims (user_id, feed_id, token, created)
+		SELECT $1, id, $3, NOW() at time zone 'utc'
+		FROM feeds WHERE id = $2
+		ON CONFLICT ON CONSTRAINT feed_claims_user_id_feed_id_key DO NOTHING;
+	`, userID, feedID, token); err != nil {
+		return nil, err
+	}
+
+	c := &Claim{FeedID: feedID}
+	row := tx.QueryRowContext(ctx, `
+		SELECT COALESCE(f.title, ''), f.feed_url, c.token, c.verified
+		FROM feed_claims c
+		INNER JOIN feeds f ON c.feed_id = f.id
+		WHERE c.user_id = $1 AND c.feed_id = $2;
+	`, userID, feedID)
+	if err := row.Scan(&c.FeedTitle, &c.FeedURL, &c.Token, &c.Verified); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// claimFeedID parses the feed id following prefix in a path, along with
+// whatever comes after it
+func claimFeedID(path, prefix string) (int, string, bool) {
+	rest := strings.TrimPrefix(path, prefix)
+	action := ""
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		rest, action = rest[:i], rest[i+1:]
+	}
+	id, err := strconv.Atoi(rest)
+	return id, action, err == nil
+}
+
+// requireCertificate asks for a client certificate, which identifies the
+// author from then on
+func requireCertificate(w gemini.ResponseWriter, user *UserContext) bool {
+	if user.Certificate == nil {
+		w.WriteHeader(60, "A client certificate is required to claim a feed")
+		return false
+	}
+	return true
+}
+
+// findFeed asks for the URL of the feed to claim, /claim
+func findFeed(ctx context.Context, w gemini.ResponseWriter, r *gemini.Request) {
+	if r.URL.RawQuery == "" {
+		w.WriteHeader(10, "Enter the URL of your feed")
+		return
+	}
+	query, err := url.QueryUnescape(r.URL.RawQuery)
+	if err != nil {
+		w.WriteHeader(10, err.Error()+": Try again")
+		return
+	}
+	query = strings.TrimSpace(query)
+
+	var feedID int
+	if err := feeds.WithTx(ctx, &sql.TxOptions{
+		ReadOnly: true,
+	}, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, `
+			SELECT id FROM feeds WHERE feed_url = $1 OR url = $1
+			ORDER BY id LIMIT 1;
+		`, query)
+		return row.Scan(&feedID)
+	}); err == sql.ErrNoRows {
+		w.WriteHeader(10, "No such feed, add it first: Try again")
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(40, "Internal server error")
+		return
+	}
+	w.WriteHeader(30, "/claim/"+strconv.Itoa(feedID))
+}
+
+// claimFeed shows the token an author puts into their feed,
+// /claim/<feed id>, and looks for it in the feed, /claim/<feed id>/verify.
+// /claim/<feed id>/revoke drops the user's claim, revoke-others drops those
+// of everyone else once the token is found in the feed again.
+func claimFeed(ctx context.Context, w gemini.ResponseWriter, r *gemini.Request) {
+	user := User(ctx)
+	if !requireCertificate(w, user) {
+		return
+	}
+	feedID, action, ok := claimFeedID(r.URL.Path, "/claim/")
+	if !ok || (action != "" && action != "verify" && action != "revoke" && action != "revoke-others") {
+		w.WriteHeader(51, "Not found")
+		return
+	}
+
+	if action == "revoke" {
+		if err := feeds.WithTx(ctx, nil, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `
+				DELETE FROM feed_claims WHERE user_id = $1 AND feed_id = $2;
+			`, user.ID, feedID)
+			return err
+		}); err != nil {
+			log.Println(err)
+			w.WriteHeader(40, "Internal server error")
+			return
+		}
+		w.WriteHeader(30, "/manage")
+		return
+	}
+
+	var claim *Claim
+	if err := feeds.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		var err error
+		claim, err = loadClaim(ctx, tx, user.ID, feedID)
+		return err
+	}); err == sql.ErrNoRows {
+		w.WriteHeader(51, "Not found")
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(40, "Internal server error")
+		return
+	}
+
+	// revoking others takes proof of controlling the feed now, a verified
+	// claim may date from a previous owner of the feed
+	if action == "verify" && claim.Verified == nil || action == "revoke-others" {
+		feedURL, err := url.Parse(claim.FeedURL)
+		if err != nil {
+			w.WriteHeader(51, "Not found")
+			return
+		}
+		data, err := feeds.Get(ctx, feedURL)
+		if err != nil {
+			w.WriteHeader(43, "Failed to fetch the feed: "+err.Error())
+			return
+		}
+		if !bytes.Contains(data, []byte(claim.Token)) {
+			w.WriteHeader(40, "The token is not in the feed yet, try again once it's published")
+			return
+		}
+		now := time.Now().UTC()
+		if err := feeds.WithTx(ctx, nil, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, `
+				UPDATE feed_claims SET verified = COALESCE(verified, $3)
+				WHERE user_id = $1 AND feed_id = $2;
+			`, user.ID, feedID, now); err != nil {
+				return err
+			}
+			if action != "revoke-others" {
+				return nil
+			}
+			result, err := tx.ExecContext(ctx, `
+				DELETE FROM feed_claims WHERE feed_id = $1 AND user_id <> $2;
+			`, feedID, user.ID)
+			if err != nil {
+				return err
+			}
+			claim.Revoked, err = result.RowsAffected()
+			return err
+		}); err != nil {
+			log.Println(err)
+			w.WriteHeader(40, "Internal server error")
+			return
+		}
+		if claim.Verified == nil {
+			claim.Verified = &now
+		}
+	}
+
+	w.WriteHeader(20, "text/gemini")
+	err := claimPage.Execute(w, &ClaimPage{
+		Claim: claim,
+		Logo:  gemmitLogo,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// registerViewKey takes the private view key of a claimed feed's address
+// as sensitive input, so it never has to be published, /viewkey/<feed id>
+func registerViewKey(ctx context.Context, w gemini.ResponseWriter, r *gemini.Request) {
+	user := User(ctx)
+	if !requireCertificate(w, user) {
+		return
+	}
+	feedID, action, ok := claimFeedID(r.URL.Path, "/viewkey/")
+	if !ok || action != "" {
+		w.WriteHeader(51, "Not found")
+		return
+	}
+
+	var (
+		claim    *Claim
+		accounts []*AcceptedPayment
+		ids      []int
+	)
+	if err := feeds.WithTx(ctx, &sql.TxOptions{
+		ReadOnly: true,
+	}, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, `
+			SELECT COALESCE(f.title, ''), c.verified
+			FROM feed_claims c
+			INNER JOIN feeds f ON c.feed_id = f.id
+			WHERE c.user_id = $1 AND c.feed_id = $2;
+		`, user.ID, feedID)
+		claim = &Claim{FeedID: feedID}
+		if err := row.Scan(&claim.FeedTitle, &claim.Verified); err != nil {
+			return err
+		}
+
+		rows, err := tx.QueryContext(ctx, `
+			SELECT ap.id, ap.pay_type, ap.address
+			FROM feeds f
+			INNER JOIN accepted_payments ap ON ap.author_id = f.author_id
+			WHERE f.id = $1 AND ap.retired IS NULL
+			ORDER BY ap.id;
+		`, feedID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var (
+				id int
+				ap AcceptedPayment
+			)
+			if err := rows.Scan(&id, &ap.PayType, &ap.Address); err != nil {
+				return err
+			}
+			if cryptonote.CoinForPayType(ap.PayType) == nil {
+				continue
+			}
+			accounts = append(accounts, &ap)
+			ids = append(ids, id)
+		}
+		return rows.Err()
+	}); err == sql.ErrNoRows {
+		w.WriteHeader(30, "/claim/"+strconv.Itoa(feedID))
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(40, "Internal server error")
+		return
+	}
+	if claim.Verified == nil {
+		w.WriteHeader(30, "/claim/"+strconv.Itoa(feedID))
+		return
+	}
+	if len(accounts) == 0 {
+		w.WriteHeader(51, "This feed has no Monero or other CryptoNote address")
+		return
+	}
+
+	if r.URL.RawQuery == "" {
+		prompt := "Private view key of the feed's address, it is never shown"
+		if viewKeyPublic != nil {
+			prompt = "Private view key of the feed's address, it is stored encrypted and never shown"
+		}
+		w.WriteHeader(11, prompt)
+		return
+	}
+	query, err := url.QueryUnescape(r.URL.RawQuery)
+	if err != nil {
+		w.WriteHeader(11, err.Error()+": Try again")
+		return
+	}
+	secret, err := cryptonote.ParseSecretKey(strings.TrimSpace(query))
+	if err != nil {
+		w.WriteHeader(11, "A view key is 64 hex characters: Try again")
+		return
+	}
+
+	// the key tells which of the addresses it is for
+	id := 0
+	var account *AcceptedPayment
+	for i, ap := range accounts {
+		coin := cryptonote.CoinForPayType(ap.PayType)
+		addr, err := coin.DecodeAddress(ap.Address)
+		if err == nil && addr.MatchesViewKey(secret) {
+			id, account = ids[i], ap
+			break
+		}
+	}
+	if account == nil {
+		w.WriteHeader(11, "The view key doesn't belong to any of the feed's addresses: Try again")
+		return
+	}
+
+	viewKey, err := sealViewKey(strings.ToLower(strings.TrimSpace(query)))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(40, "Internal server error")
+		return
+	}
+	if err := feeds.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		// the light wallet server gets to know the new key on the next fetch
+		_, err := tx.ExecContext(ctx, `
+			UPDATE accepted_payments SET view_key = $2, view_key_checked = true, registered = false
+			WHERE id = $1;
+		`, id, viewKey)
+		return err
+	}); err != nil {
+		log.Println(err)
+		w.WriteHeader(40, "Internal server error")
+		return
+	}
+
+	w.WriteHeader(20, "text/gemini")
+	err = viewKeyPage.Execute(w, &ViewKeyPage{
+		Claim:   claim,
+		Account: account,
+		Logo:    gemmitLogo,
+		Sealed:  viewKeyPublic != nil,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
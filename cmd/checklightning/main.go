@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"log"
+	"time"
+
+	feeds "github.com/t-900-a/gemmit/feeds"
+	"github.com/t-900-a/gemmit/lightning"
+	"github.com/t-900-a/gemmit/votes"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+)
+
+func main() {
+	grace := flag.Duration("grace", 24*time.Hour,
+		"how long after expiring an invoice is still checked")
+	test := flag.Bool("test", false,
+		"check invoices of cmd/lnurlstub, trusting any certificate and local addresses")
+	flag.Parse()
+
+	db, err := sql.Open("pgx", flag.Arg(0))
+	if err != nil {
+		panic(err)
+	}
+
+	client := lightning.NewClient("bc")
+	if *test {
+		client = lightning.NewTestClient()
+	}
+	ctx := feeds.DBContext(context.TODO(), db)
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	if err := conn.Raw(func(driverConn interface{}) error {
+		conn := driverConn.(*stdlib.Conn).Conn()
+
+		invoices, err := votes.OpenInvoices(ctx, conn, time.Now().UTC().Add(-*grace))
+		if err != nil {
+			return err
+		}
+		for _, inv := range invoices {
+			if err := check(ctx, conn, client, inv); err != nil {
+				log.Printf("Failed to check invoice %d: %v", inv.ID, err)
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// check asks the author's server whether an invoice was paid and marks it
+// paid if it was, as an unverified vote
+func check(ctx context.Context, conn *pgx.Conn, client *lightning.Client, inv *votes.Invoice) error {
+	settled, err := client.Verify(ctx, inv.Verify, inv.PaymentHash)
+	if err != nil || !settled {
+		return err
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if err := votes.SettleInvoice(ctx, tx, inv, time.Now().UTC()); err != nil {
+		return err
+	}
+	log.Printf("Invoice %d for %d sats to account %d reported paid", inv.ID, inv.Amount, inv.AcceptedPaymentID)
+	return tx.Commit(ctx)
+}
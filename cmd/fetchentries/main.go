@@ -65,13 +65,13 @@ func main() {
 			u, _ := url.Parse(f.URL)
 			feed, _, err := feeds.Fetch(ctx, u)
 			if err != nil {
-				log.Println("Error: %v", err)
+				log.Printf("Error: %v", err)
 				continue
 			}
 
 			err = feeds.Index(ctx, tx, feed.Items, f.ID)
 			if err != nil {
-				log.Println("Error: %v", err)
+				log.Printf("Error: %v", err)
 				continue
 			}
 		}
@@ -5,26 +5,64 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 	"time"
 
+	"github.com/t-900-a/gemmit/cryptonote"
 	feeds "github.com/t-900-a/gemmit/feeds"
+	"github.com/t-900-a/gemmit/viewkeys"
+	"github.com/t-900-a/gemmit/votes"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/stdlib"
 )
 
 func main() {
-	db, err := sql.Open("pgx", os.Args[1])
+	coinName := flag.String("coin", "monero", "CryptoNote coin to fetch, monero or wownero")
+	rules := votes.DefaultRules(0) // the block time depends on the coin
+	rules.Flags(flag.CommandLine)
+	keyringPath := flag.String("view-keys", "",
+		"file with the private keys view keys are sealed to, $"+viewkeys.KeyringEnv+" if empty")
+	rescan := flag.Bool("rescan", false,
+		"compare the recorded votes with the light wallet server's history instead of fetching new ones")
+	only := flag.Int("account", 0, "accepted payment to rescan, all of them if 0")
+	from := flag.Uint64("from", 0, "height to rescan from")
+	repair := flag.Bool("repair", false,
+		"fix what the rescan finds and fetch the accounts again from -from on the next run")
+	flag.Parse()
+
+	coin := cryptonote.CoinByName(*coinName)
+	if coin == nil {
+		log.Fatalf("Unknown coin %s", *coinName)
+	}
+	rules.BlockTime = coin.BlockTime
+	if err := rules.SetCurrency(coin.Currency); err != nil {
+		log.Fatal(err)
+	}
+
+	keyring, err := viewkeys.LoadKeyring(*keyringPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := sql.Open("pgx", flag.Arg(0))
 	if err != nil {
 		panic(err)
 	}
 
-	lightwallet := os.Args[2] // https://api.mymonero.com:8443
+	lightwallet := coin.LightWallet
+	if flag.NArg() > 1 {
+		lightwallet = flag.Arg(1)
+	}
+	if lightwallet == "" {
+		log.Fatalf("There is no default light wallet server for %s", coin.Name)
+	}
 
 	ctx := feeds.DBContext(context.TODO(), db)
 	conn, err := db.Conn(ctx)
@@ -33,176 +71,376 @@ func main() {
 	}
 	defer conn.Close()
 
-	conn.Raw(func(driverConn interface{}) error {
+	if err := conn.Raw(func(driverConn interface{}) error {
 		conn := driverConn.(*stdlib.Conn).Conn()
-		tx, err := conn.Begin(ctx)
+
+		accounts, err := loadAccounts(ctx, conn, coin, keyring)
 		if err != nil {
 			return err
 		}
-
-		defer func() {
-			if err := recover(); err != nil {
-				tx.Rollback(ctx)
-				panic(err)
+		for _, a := range accounts {
+			if *rescan {
+				if *only != 0 && a.ID != *only {
+					continue
+				}
+				if err := rescanAccount(ctx, conn, coin, lightwallet, rules, a, *from, *repair); err != nil {
+					log.Printf("Failed to rescan %s account %d: %v", coin.Name, a.ID, err)
+				}
+				time.Sleep(1 * time.Second)
+				continue
 			}
-		}()
-		// update payment records for all authors
-		rows, err := tx.Query(ctx, `
-			SELECT id, view_key, address, registered, scan_height
-			FROM accepted_payments 
-			WHERE pay_type = $1;
-		`, "application/monero-paymentrequest")
-		if err != nil {
-			panic(err)
-		}
-		var toRefresh []*struct {
-			ID            int
-			ViewKey       string
-			Address       string
-			Registered    bool
-			ScannedHeight int
+			// every account is committed on its own, one failing or the
+			// process dying doesn't lose the others
+			if err := fetchAccount(ctx, conn, coin, lightwallet, rules, a); err != nil {
+				log.Printf("Failed to fetch %s account %d: %v", coin.Name, a.ID, err)
+			}
+			time.Sleep(1 * time.Second)
 		}
+		return nil
+	}); err != nil {
+		log.Fatal(err)
+	}
+}
 
-		for rows.Next() {
-			account := &struct {
-				ID            int
-				ViewKey       string
-				Address       string
-				Registered    bool
-				ScannedHeight int
-			}{}
-			if err := rows.Scan(&account.ID, &account.ViewKey, &account.Address, &account.Registered, &account.ScannedHeight); err != nil {
-				panic(err)
-			}
-			toRefresh = append(toRefresh, account)
+type account struct {
+	ID            int
+	ViewKey       string
+	Address       string
+	Registered    bool
+	ScannedHeight int
+}
+
+func loadAccounts(ctx context.Context, conn *pgx.Conn, coin *cryptonote.Coin, keyring *viewkeys.Keyring) ([]*account, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT id, view_key, address, registered, COALESCE(scan_height, 0)
+		FROM accepted_payments
+		WHERE pay_type = $1 AND view_key <> '' AND retired IS NULL;
+	`, coin.Currency.PayType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []*account
+	for rows.Next() {
+		a := &account{}
+		if err := rows.Scan(&a.ID, &a.ViewKey, &a.Address, &a.Registered, &a.ScannedHeight); err != nil {
+			return nil, err
+		}
+		viewKey, err := keyring.Open(a.ViewKey)
+		if err != nil {
+			log.Printf("Skipping %s account %d: %v", coin.Name, a.ID, err)
+			continue
 		}
+		a.ViewKey = viewKey
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
 
-		for _, a := range toRefresh {
-			if !a.Registered {
-				// login for unregistered accounts
-				method := "/login"
-				strData := `{"address":"` + a.Address + `","view_key":"` + a.ViewKey + `","create_account":true,"generated_locally":false}`
-				jsonData := []byte(strData)
-				u, _ := url.ParseRequestURI(lightwallet)
-				u.Path = method
-				urlStr := u.String()
-				client := &http.Client{}
-				r, _ := http.NewRequest(http.MethodPost, urlStr, bytes.NewBuffer(jsonData))
-				r.Header.Add("Accept", "application/json")
-				r.Header.Add("Accept-Encoding", "gzip, deflate, br")
-				r.Header.Add("Content-Type", "application/json")
-				r.Header.Add("Content-Length", strconv.Itoa(len(jsonData)))
-
-				resp, err := client.Do(r)
-				if err != nil {
-					log.Println(err)
-				}
+// post calls a light wallet server API method
+func post(ctx context.Context, lightwallet, method string, data, out interface{}) error {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	u, err := url.ParseRequestURI(lightwallet)
+	if err != nil {
+		return err
+	}
+	u.Path = method
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	r.Header.Add("Accept", "application/json")
+	r.Header.Add("Content-Type", "application/json")
+	r.Header.Add("Content-Length", strconv.Itoa(len(jsonData)))
 
-				if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
-					body, err := ioutil.ReadAll(resp.Body)
-					if err != nil {
-						log.Println(err)
-					}
-
-					type Login struct {
-						NewAddress  bool `json:"new_address"`
-						StartHeight int  `json:"start_height"`
-					}
-
-					var l = new(Login)
-					err = json.Unmarshal(body, &l)
-					if err != nil {
-						log.Println(err)
-					}
-					a.Registered = true
-					tx.Exec(ctx, `
-						UPDATE accepted_payments SET registered=$2 WHERE id = $1
-						`, a.ID, a.Registered)
-				} else {
-					log.Println("Failed to register / login to ", lightwallet, " for Monero account ", a.Address)
-				}
+	client := &http.Client{Timeout: 2 * time.Minute}
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s to %s", lightwallet, resp.Status, method)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, out)
+}
+
+type Transaction struct {
+	Id            uint64    `json:"id"`
+	Hash          string    `json:"hash"`
+	Timestamp     time.Time `json:"timestamp"`
+	TotalReceived string    `json:"total_received"`
+	TotalSent     string    `json:"total_sent"`
+	UnlockTime    uint64    `json:"unlock_time"`
+	Height        int       `json:"height"`
+	//SpentOutputs  []struct{} `json:"spent_outputs"`
+	PaymentId string `json:"payment_id"`
+	Coinbase  bool   `json:"coinbase"`
+	Mempool   bool   `json:"mempool"`
+	Mixin     uint32 `json:"mixin"`
+}
+
+type Txs struct {
+	TotalReceived      uint64        `json:"total_received"`
+	ScannedBlockHeight uint64        `json:"scanned_block_height"`
+	StartHeight        uint64        `json:"start_height"`
+	BlockchainHeight   uint64        `json:"blockchain_height"`
+	Transactions       []Transaction `json:"transactions"`
+}
+
+// addressTxs gets the transactions of an account from the light wallet
+// server, everything since the account was registered
+func addressTxs(ctx context.Context, lightwallet string, a *account) (*Txs, error) {
+	ts := new(Txs)
+	if err := post(ctx, lightwallet, "/get_address_txs", map[string]string{
+		"address":  a.Address,
+		"view_key": a.ViewKey,
+	}, ts); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+func incoming(a *account, account *cryptonote.Account, t *Transaction) (*votes.Incoming, error) {
+	// amounts stay in atomic units, they're only converted for display
+	received, err := strconv.ParseUint(t.TotalReceived, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	sent, err := strconv.ParseUint(t.TotalSent, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	height := uint64(t.Height)
+	if t.Mempool {
+		height = 0
+	}
+	return &votes.Incoming{
+		Payment: votes.Payment{
+			AcceptedPaymentID: a.ID,
+			Address:           a.Address,
+			TxID:              t.Hash,
+			Date:              t.Timestamp,
+			Amount:            received,
+			Height:            height,
+			// light wallets don't know subaddresses, only
+			// integrated addresses can be told apart
+			EntryID: account.PaymentIDs[t.PaymentId],
+		},
+		Sent:       sent,
+		Coinbase:   t.Coinbase,
+		UnlockTime: t.UnlockTime,
+	}, nil
+}
+
+// fetchAccount records the votes the light wallet server found for an
+// account, in a transaction of its own
+func fetchAccount(ctx context.Context, conn *pgx.Conn, coin *cryptonote.Coin, lightwallet string,
+	rules *votes.Rules, a *account) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	account, err := cryptoNoteAccount(ctx, tx, coin, a.ID, a.Address, a.ViewKey)
+	if err != nil {
+		log.Printf("Skipping %s account %d: %v", coin.Name, a.ID, err)
+		return nil
+	}
+
+	if !a.Registered {
+		// login for unregistered accounts
+		var l struct {
+			NewAddress  bool `json:"new_address"`
+			StartHeight int  `json:"start_height"`
+		}
+		if err := post(ctx, lightwallet, "/login", map[string]interface{}{
+			"address":           a.Address,
+			"view_key":          a.ViewKey,
+			"create_account":    true,
+			"generated_locally": false,
+		}, &l); err != nil {
+			log.Printf("Failed to register / login to %s for %s account %s: %v",
+				lightwallet, coin.Name, a.Address, err)
+		} else {
+			a.Registered = true
+			if _, err := tx.Exec(ctx, `
+				UPDATE accepted_payments SET registered=$2 WHERE id = $1
+			`, a.ID, a.Registered); err != nil {
+				return err
 			}
+		}
+	}
+
+	ts, err := addressTxs(ctx, lightwallet, a)
+	if err != nil {
+		return err
+	}
 
-			// get transactions for address
-			method := "/get_address_txs"
-			strData := `{"address":"` + a.Address + `","view_key":"` + a.ViewKey + `"}`
-			jsonData := []byte(strData)
-			u, _ := url.ParseRequestURI(lightwallet)
-			u.Path = method
-			urlStr := u.String()
-
-			client := &http.Client{}
-			r, _ := http.NewRequest(http.MethodPost, urlStr, bytes.NewBuffer(jsonData))
-			r.Header.Add("Accept", "application/json")
-			r.Header.Add("Accept-Encoding", "gzip, deflate, br")
-			r.Header.Add("Content-Type", "application/json")
-			r.Header.Add("Content-Length", strconv.Itoa(len(jsonData)))
-
-			resp, err := client.Do(r)
+	// pending votes are recorded from scratch every time, and the
+	// most recent blocks are checked again so that payments which
+	// were reorganised out of the chain are removed
+	if err := votes.ClearPending(ctx, tx, a.ID); err != nil {
+		return err
+	}
+	// several transactions can share a height, compare against
+	// the height from before this scan rather than the last seen
+	scanned := a.ScannedHeight - int(rules.ReorgDepth)
+	if scanned < 0 {
+		scanned = 0
+	}
+	hashes := make([]string, 0, len(ts.Transactions))
+	for _, t := range ts.Transactions {
+		hashes = append(hashes, t.Hash)
+	}
+	if err := votes.Vanished(ctx, tx, a.ID, uint64(scanned+1), ts.BlockchainHeight, hashes); err != nil {
+		return err
+	}
+	// the scan height can't move past a transaction that may still count
+	deferred := -1
+	for _, t := range ts.Transactions {
+		in, err := incoming(a, account, &t)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if (scanned < t.Height || t.Mempool) && in.Amount > 0 {
+			verdict, err := rules.Apply(ctx, tx, in, ts.BlockchainHeight)
 			if err != nil {
-				log.Println(err)
+				return err
 			}
 
-			if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
-				body, err := ioutil.ReadAll(resp.Body)
-				if err != nil {
-					log.Println(err)
+			if verdict == votes.Defer {
+				if !t.Mempool && (deferred < 0 || t.Height < deferred) {
+					deferred = t.Height
 				}
+				continue
+			}
+			if a.ScannedHeight < t.Height {
+				a.ScannedHeight = t.Height
+			}
+		}
+	}
+	if deferred >= 0 && a.ScannedHeight >= deferred {
+		a.ScannedHeight = deferred - 1
+		if a.ScannedHeight < scanned {
+			a.ScannedHeight = scanned
+		}
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE accepted_payments SET scan_height=$2 WHERE id = $1
+	`, a.ID, a.ScannedHeight); err != nil {
+		return err
+	}
+	// the server scans on its own, this is how far it got
+	if err := votes.Synced(ctx, tx, a.ID, ts.ScannedBlockHeight, ts.BlockchainHeight); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
 
-				type Transaction struct {
-					Id            uint64    `json:"id"`
-					Hash          string    `json:"hash"`
-					Timestamp     time.Time `json:"timestamp"`
-					TotalReceived string    `json:"total_received"`
-					TotalSent     string    `json:"total_sent"`
-					UnlockTime    uint64    `json:"unlock_time"`
-					Height        int       `json:"height"`
-					//SpentOutputs  []struct{} `json:"spent_outputs"`
-					//PaymentId     byte       `json:"payment_id"`
-					Coinbase bool   `json:"coinbase"`
-					Mempool  bool   `json:"mempool"`
-					Mixin    uint32 `json:"mixin"`
-				}
-				type Txs struct {
-					TotalReceived      uint64        `json:"total_received"`
-					ScannedHeight      uint64        `json:"total_received"`
-					ScannedBlockHeight uint64        `json:"scanned_block_height"`
-					StartHeight        uint64        `json:"start_height"`
-					BlockchainHeight   uint64        `json:"blockchain_height"`
-					Transactions       []Transaction `json:"transactions"`
-				}
+// rescanAccount reports how the recorded votes of an account differ from
+// its history on the light wallet server, and repairs them if asked to
+func rescanAccount(ctx context.Context, conn *pgx.Conn, coin *cryptonote.Coin, lightwallet string,
+	rules *votes.Rules, a *account, from uint64, repair bool) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
 
-				var ts = new(Txs)
-				err = json.Unmarshal(body, &ts)
-				if err != nil {
-					log.Println(err)
-				}
-				for _, t := range ts.Transactions {
-					received, _ := strconv.ParseFloat(t.TotalReceived, 64)
-					if a.ScannedHeight < t.Height && received > float64(0) {
-						// convert from piconeros
-						received = received * float64(0.000000000001)
-						// transaction hasn't been recorded
-						if _, err := tx.Exec(ctx, `
-							INSERT INTO payments (
-								address, tx_id, tx_date, amount, accepted_payments_id
-							) VALUES ($1, $2, $3, $4, $5);
-							`, a.Address, t.Hash, t.Timestamp, received, a.ID); err != nil {
-							return err
-						}
-
-						a.ScannedHeight = t.Height
-					}
-				}
-			} else {
-				log.Println("Failed to register / login to ", lightwallet, " for Monero account ", a.Address)
-			}
-			tx.Exec(ctx, `
-				UPDATE accepted_payments SET scan_height=$2 WHERE id = $1
-				`, a.ID, a.ScannedHeight)
-			time.Sleep(1 * time.Second)
+	account, err := cryptoNoteAccount(ctx, tx, coin, a.ID, a.Address, a.ViewKey)
+	if err != nil {
+		return err
+	}
+	ts, err := addressTxs(ctx, lightwallet, a)
+	if err != nil {
+		return err
+	}
+	var scanned []*votes.Incoming
+	for i := range ts.Transactions {
+		in, err := incoming(a, account, &ts.Transactions[i])
+		if err != nil {
+			log.Println(err)
+			continue
 		}
-		tx.Commit(ctx)
+		if in.Amount > 0 {
+			scanned = append(scanned, in)
+		}
+	}
+
+	// votes for entries may have been paid to subaddresses, which only
+	// scanmonero -rescan sees
+	found, err := rules.Reconcile(ctx, tx, a.ID, from, scanned, ts.BlockchainHeight, votes.MainAddressPayments)
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		log.Printf("%s account %d matches its history from height %d", coin.Name, a.ID, from)
+	}
+	for _, d := range found {
+		log.Printf("%s account %d: %s", coin.Name, a.ID, d)
+	}
+	if !repair {
 		return nil
-	})
+	}
+
+	for _, d := range found {
+		if err := rules.Repair(ctx, tx, d, ts.BlockchainHeight); err != nil {
+			return err
+		}
+	}
+	// whatever is pending or recent is fetched again on the next run
+	if from > 0 {
+		from--
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE accepted_payments SET scan_height = LEAST(COALESCE(scan_height, 0), $2)
+		WHERE id = $1
+	`, a.ID, from); err != nil {
+		return err
+	}
+	log.Printf("Repaired %d payments of %s account %d", len(found), coin.Name, a.ID)
+	return tx.Commit(ctx)
+}
+
+// cryptoNoteAccount decodes an accepted payment along with the integrated
+// addresses published for votes on single entries
+func cryptoNoteAccount(ctx context.Context, tx pgx.Tx, coin *cryptonote.Coin, id int, address, viewKey string) (*cryptonote.Account, error) {
+	addr, err := coin.DecodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := cryptonote.ParseSecretKey(viewKey)
+	if err != nil {
+		return nil, err
+	}
+	account := &cryptonote.Account{
+		ViewSecret: secret,
+		SpendPub:   addr.SpendPub,
+	}
+
+	entries, err := votes.EntryAddresses(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	for address, entryID := range entries {
+		entryAddr, err := coin.DecodeAddress(address)
+		if err != nil || entryAddr.Kind != cryptonote.IntegratedAddress {
+			continue
+		}
+		if err := account.AddAddress(entryAddr, entryID); err != nil {
+			log.Printf("Skipping address of entry %d: %v", entryID, err)
+		}
+	}
+	return account, nil
 }
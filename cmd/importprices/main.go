@@ -0,0 +1,171 @@
+// importprices loads dated exchange rates which votes in different
+// currencies are compared by. Either CSV with date,ticker,price rows or a
+// JSON array of {"date", "ticker", "price"} objects, prices being the value
+// of one whole coin in a reference currency of the admin's choosing.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/t-900-a/gemmit/currency"
+	feeds "github.com/t-900-a/gemmit/feeds"
+
+	"github.com/jackc/pgx/v4/stdlib"
+)
+
+type price struct {
+	Date   time.Time
+	Ticker string
+	Price  string
+}
+
+func main() {
+	format := flag.String("format", "", "csv or json, guessed from the file extension if empty")
+	flag.Parse()
+
+	f, err := os.Open(flag.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(flag.Arg(1))), ".")
+	}
+	var prices []*price
+	switch *format {
+	case "csv":
+		prices, err = readCSV(f)
+	case "json":
+		prices, err = readJSON(f)
+	default:
+		err = fmt.Errorf("Unknown format %q, use -format csv or json", *format)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := sql.Open("pgx", flag.Arg(0))
+	if err != nil {
+		panic(err)
+	}
+
+	ctx := feeds.DBContext(context.TODO(), db)
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	if err := conn.Raw(func(driverConn interface{}) error {
+		conn := driverConn.(*stdlib.Conn).Conn()
+
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		unknown := make(map[string]bool)
+		for _, p := range prices {
+			if !knownTicker(p.Ticker) && !unknown[p.Ticker] {
+				unknown[p.Ticker] = true
+				log.Printf("No currency with ticker %s, importing its prices anyway", p.Ticker)
+			}
+			if _, err := tx.Exec(ctx, `
+				INSERT INTO prices (ticker, date, price)
+				VALUES ($1, $2, $3::numeric)
+				ON CONFLICT (ticker, date) DO UPDATE SET price = EXCLUDED.price
+			`, p.Ticker, p.Date, p.Price); err != nil {
+				return fmt.Errorf("%s %s: %v", p.Ticker, p.Date.Format("2006-01-02"), err)
+			}
+		}
+		log.Printf("Imported %d prices", len(prices))
+		return tx.Commit(ctx)
+	}); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func knownTicker(ticker string) bool {
+	for _, c := range currency.Currencies {
+		if c.Ticker == ticker {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePrice(date, ticker, value string) (*price, error) {
+	d, err := time.Parse("2006-01-02", strings.TrimSpace(date))
+	if err != nil {
+		return nil, err
+	}
+	ticker = strings.ToUpper(strings.TrimSpace(ticker))
+	if ticker == "" {
+		return nil, errors.New("Missing ticker")
+	}
+	value = strings.TrimSpace(value)
+	if value == "" || strings.HasPrefix(value, "-") {
+		return nil, fmt.Errorf("Invalid price %q", value)
+	}
+	return &price{Date: d, Ticker: ticker, Price: value}, nil
+}
+
+// readCSV reads date,ticker,price rows, a header row is skipped
+func readCSV(r io.Reader) ([]*price, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var prices []*price
+	for i, record := range records {
+		if len(record) != 3 {
+			return nil, fmt.Errorf("Line %d: expected date,ticker,price", i+1)
+		}
+		if i == 0 && strings.EqualFold(strings.TrimSpace(record[0]), "date") {
+			continue
+		}
+		p, err := parsePrice(record[0], record[1], record[2])
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", i+1, err)
+		}
+		prices = append(prices, p)
+	}
+	return prices, nil
+}
+
+// readJSON reads an array of objects, prices may be numbers or strings
+func readJSON(r io.Reader) ([]*price, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var records []struct {
+		Date   string      `json:"date"`
+		Ticker string      `json:"ticker"`
+		Price  json.Number `json:"price"`
+	}
+	if err := dec.Decode(&records); err != nil {
+		return nil, err
+	}
+	var prices []*price
+	for i, record := range records {
+		p, err := parsePrice(record.Date, record.Ticker, record.Price.String())
+		if err != nil {
+			return nil, fmt.Errorf("Entry %d: %v", i+1, err)
+		}
+		prices = append(prices, p)
+	}
+	return prices, nil
+}
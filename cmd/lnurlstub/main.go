@@ -0,0 +1,221 @@
+// lnurlstub stands in for an author's LNURL-pay server when testing
+// Lightning votes. It hands out regtest invoices which are never payable,
+// visiting /pay/<payment hash> marks one as paid instead. It speaks https
+// with a self-signed certificate, run gemmit with -lightning-test to use it.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/t-900-a/gemmit/lightning"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+type invoice struct {
+	PR       string
+	Preimage string
+	Settled  bool
+}
+
+type stub struct {
+	base     string
+	key      *btcec.PrivateKey
+	verify   bool
+	mu       sync.Mutex
+	invoices map[string]*invoice
+}
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:8089", "address to listen on")
+	verify := flag.Bool("verify", true, "offer LUD-21 verify URLs, without them voters enter the preimage")
+	flag.Parse()
+
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		panic(err)
+	}
+	s := &stub{
+		base:     "https://" + *listen,
+		key:      key,
+		verify:   *verify,
+		invoices: make(map[string]*invoice),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/lnurlp/", s.payRequest)
+	mux.HandleFunc("/callback/", s.callback)
+	mux.HandleFunc("/verify/", s.status)
+	mux.HandleFunc("/pay/", s.pay)
+
+	// LNURL is https only, the test server's certificate is self-signed,
+	// which gemmit's -lightning-test client accepts
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.StartTLS()
+	log.Printf("Publish lightning:anyone@%s as the payment request of a feed", *listen)
+	select {}
+}
+
+func metadata(user string) string {
+	return `[["text/plain","Vote for ` + user + ` on gemmit"]]`
+}
+
+func reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func fail(w http.ResponseWriter, reason string) {
+	reply(w, map[string]string{"status": "ERROR", "reason": reason})
+}
+
+func (s *stub) payRequest(w http.ResponseWriter, r *http.Request) {
+	user := strings.TrimPrefix(r.URL.Path, "/.well-known/lnurlp/")
+	reply(w, &lightning.PayRequest{
+		Tag:         "payRequest",
+		Callback:    s.base + "/callback/" + user,
+		MinSendable: 1000,
+		MaxSendable: 100000000,
+		Metadata:    metadata(user),
+	})
+}
+
+func (s *stub) callback(w http.ResponseWriter, r *http.Request) {
+	user := strings.TrimPrefix(r.URL.Path, "/callback/")
+	amount, err := strconv.ParseUint(r.URL.Query().Get("amount"), 10, 64)
+	if err != nil || amount < 1000 || amount > 100000000 {
+		fail(w, "Amount out of range")
+		return
+	}
+
+	preimage := make([]byte, 32)
+	if _, err := rand.Read(preimage); err != nil {
+		fail(w, err.Error())
+		return
+	}
+	hash := sha256.Sum256(preimage)
+	description := sha256.Sum256([]byte(metadata(user)))
+	pr, err := s.encode(amount, hash[:], description[:])
+	if err != nil {
+		fail(w, err.Error())
+		return
+	}
+
+	paymentHash := hex.EncodeToString(hash[:])
+	s.mu.Lock()
+	s.invoices[paymentHash] = &invoice{
+		PR:       pr,
+		Preimage: hex.EncodeToString(preimage),
+	}
+	s.mu.Unlock()
+
+	resp := &lightning.InvoiceResponse{PR: pr}
+	if s.verify {
+		resp.Verify = s.base + "/verify/" + paymentHash
+	}
+	log.Printf("Invoice for %d msat, pay it at %s/pay/%s", amount, s.base, paymentHash)
+	reply(w, resp)
+}
+
+func (s *stub) status(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inv, ok := s.invoices[strings.TrimPrefix(r.URL.Path, "/verify/")]
+	if !ok {
+		fail(w, "Not found")
+		return
+	}
+	resp := map[string]interface{}{
+		"status":   "OK",
+		"settled":  inv.Settled,
+		"preimage": nil,
+		"pr":       inv.PR,
+	}
+	if inv.Settled {
+		resp["preimage"] = inv.Preimage
+	}
+	reply(w, resp)
+}
+
+// pay is what a voter's wallet would do, it answers with the preimage a
+// wallet shows as proof of payment
+func (s *stub) pay(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inv, ok := s.invoices[strings.TrimPrefix(r.URL.Path, "/pay/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	inv.Settled = true
+	fmt.Fprintln(w, inv.Preimage)
+}
+
+// encode builds a regtest BOLT11 invoice
+func (s *stub) encode(msat uint64, paymentHash, descriptionHash []byte) (string, error) {
+	// pico bitcoin are tenths of a millisatoshi
+	hrp := "lnbcrt" + strconv.FormatUint(msat*10, 10) + "p"
+
+	data := toGroups(uint64(time.Now().Unix()), 7)
+	for _, field := range []struct {
+		tag   byte
+		value []byte
+	}{
+		{1, paymentHash},
+		{23, descriptionHash},
+	} {
+		groups, err := lightning.ConvertBits(field.value, 8, 5, true)
+		if err != nil {
+			return "", err
+		}
+		data = append(data, field.tag)
+		data = append(data, toGroups(uint64(len(groups)), 2)...)
+		data = append(data, groups...)
+	}
+
+	// the signature covers the human readable part and the data as bytes
+	b, err := lightning.ConvertBits(data, 5, 8, true)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(append([]byte(hrp), b...))
+	compact, err := btcec.SignCompact(btcec.S256(), s.key, digest[:], true)
+	if err != nil {
+		return "", err
+	}
+	// compact signatures lead with the recovery id, BOLT11 puts it last
+	recovery := (compact[0] - 27) & 3
+	sig, err := lightning.ConvertBits(append(compact[1:], recovery), 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	return lightning.EncodeBech32(hrp, append(data, sig...)), nil
+}
+
+func toGroups(n uint64, count int) []byte {
+	groups := make([]byte, count)
+	for i := count - 1; i >= 0; i-- {
+		groups[i] = byte(n & 31)
+		n >>= 5
+	}
+	return groups
+}
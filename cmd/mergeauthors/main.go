@@ -0,0 +1,121 @@
+// mergeauthors folds duplicate authors into one, so their feeds and votes
+// are counted together.
+//
+//	mergeauthors <db>
+//	mergeauthors <db> <author id to keep> <duplicate author id>...
+//
+// Without ids it suggests authors sharing an email or URI. Submissions are
+// never matched by those, anyone can write them into a feed, so check that
+// the suggested authors really are the same before merging them.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+
+	feeds "github.com/t-900-a/gemmit/feeds"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+)
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 || flag.NArg() == 2 {
+		log.Fatal("Usage: mergeauthors <db> [<author id to keep> <duplicate author id>...]")
+	}
+	var ids []int
+	for _, arg := range flag.Args()[1:] {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			log.Fatalf("Invalid author id %q", arg)
+		}
+		ids = append(ids, id)
+	}
+
+	db, err := sql.Open("pgx", flag.Arg(0))
+	if err != nil {
+		panic(err)
+	}
+
+	ctx := feeds.DBContext(context.TODO(), db)
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	if err := conn.Raw(func(driverConn interface{}) error {
+		conn := driverConn.(*stdlib.Conn).Conn()
+
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		if len(ids) == 0 {
+			return listDuplicates(ctx, tx)
+		}
+		for _, id := range ids {
+			var exists bool
+			if err := tx.QueryRow(ctx, `
+				SELECT EXISTS (SELECT 1 FROM authors WHERE id = $1);
+			`, id).Scan(&exists); err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("No author %d", id)
+			}
+		}
+		if err := feeds.MergeAuthors(ctx, tx, ids[0], ids[1:]); err != nil {
+			return err
+		}
+		log.Printf("Merged authors %v into %d", ids[1:], ids[0])
+		return tx.Commit(ctx)
+	}); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// listDuplicates suggests authors sharing an email or URI, oldest first
+func listDuplicates(ctx context.Context, tx pgx.Tx) error {
+	rows, err := tx.Query(ctx, `
+		SELECT match, array_agg(id ORDER BY id)
+		FROM (
+			SELECT id, 'email ' || lower(email) AS match FROM authors WHERE email <> ''
+			UNION
+			SELECT id, 'URI ' || rtrim(url, '/') FROM authors WHERE url <> ''
+		) a
+		GROUP BY match
+		HAVING count(*) > 1
+		ORDER BY match;
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	found := 0
+	for rows.Next() {
+		var (
+			match string
+			ids   []int32
+		)
+		if err := rows.Scan(&match, &ids); err != nil {
+			return err
+		}
+		fmt.Printf("%s: %v\n", match, ids)
+		found++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if found == 0 {
+		log.Println("No authors share an email or URI")
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"log"
+	"time"
+
+	"github.com/t-900-a/gemmit/bitcoin"
+	"github.com/t-900-a/gemmit/currency"
+	feeds "github.com/t-900-a/gemmit/feeds"
+	"github.com/t-900-a/gemmit/votes"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+)
+
+type account struct {
+	ID            int
+	Address       string
+	ScannedHeight uint64
+	Wallet        *bitcoin.Wallet
+}
+
+func main() {
+	rules := votes.DefaultRules(10 * time.Minute)
+	rules.Confirmations = 6
+	rules.ReorgDepth = 12
+	rules.Flags(flag.CommandLine)
+	gapLimit := flag.Uint("gap-limit", 20,
+		"unused addresses derived from an extended public key before giving up")
+	testnet := flag.Bool("testnet", false, "scan testnet instead of mainnet")
+	flag.Parse()
+	if err := rules.SetCurrency(currency.Bitcoin); err != nil {
+		log.Fatal(err)
+	}
+
+	params := &chaincfg.MainNetParams
+	if *testnet {
+		params = &chaincfg.TestNet3Params
+	}
+
+	db, err := sql.Open("pgx", flag.Arg(0))
+	if err != nil {
+		panic(err)
+	}
+
+	esplora, err := bitcoin.NewEsplora(flag.Arg(1)) // https://blockstream.info/api
+	if err != nil {
+		panic(err)
+	}
+
+	ctx := feeds.DBContext(context.TODO(), db)
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	if err := conn.Raw(func(driverConn interface{}) error {
+		conn := driverConn.(*stdlib.Conn).Conn()
+
+		accounts, err := loadAccounts(ctx, conn, params)
+		if err != nil {
+			return err
+		}
+		tip, err := esplora.Height(ctx)
+		if err != nil {
+			return err
+		}
+		for _, a := range accounts {
+			// one account failing shouldn't hold up the others
+			if err := scanAccount(ctx, conn, esplora, a, tip, uint32(*gapLimit), rules); err != nil {
+				log.Printf("Failed to scan Bitcoin account %d: %v", a.ID, err)
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func loadAccounts(ctx context.Context, conn *pgx.Conn, params *chaincfg.Params) ([]*account, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT id, address, COALESCE(scan_height, 0)
+		FROM accepted_payments
+		WHERE pay_type = $1 AND retired IS NULL;
+	`, currency.Bitcoin.PayType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []*account
+	for rows.Next() {
+		var a account
+		if err := rows.Scan(&a.ID, &a.Address, &a.ScannedHeight); err != nil {
+			return nil, err
+		}
+		// older rows kept the whole bitcoin: URI
+		wallet, err := bitcoin.ParseWallet(bitcoin.StripURI(a.Address), params)
+		if err != nil {
+			log.Printf("Skipping Bitcoin account %d: %v", a.ID, err)
+			continue
+		}
+		a.Wallet = wallet
+		accounts = append(accounts, &a)
+	}
+	return accounts, rows.Err()
+}
+
+// addresses lists the addresses to fetch transactions for, and all the
+// addresses that belong to the account. Derivation stops once gapLimit
+// addresses in a row were never used.
+func addresses(ctx context.Context, esplora *bitcoin.Esplora, w *bitcoin.Wallet,
+	gapLimit uint32) (used []string, owned map[string]bool, err error) {
+	owned = make(map[string]bool)
+	if !w.Extended() {
+		owned[w.Address] = true
+		return []string{w.Address}, owned, nil
+	}
+	for _, chain := range []uint32{bitcoin.External, bitcoin.Internal} {
+		unused := uint32(0)
+		for index := uint32(0); unused < gapLimit; index++ {
+			address, err := w.Derive(chain, index)
+			if err != nil {
+				// invalid children are skipped, they are rare enough
+				// not to count towards the gap
+				continue
+			}
+			owned[address] = true
+			ok, err := esplora.Used(ctx, address)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !ok {
+				unused++
+				continue
+			}
+			unused = 0
+			used = append(used, address)
+		}
+	}
+	return used, owned, nil
+}
+
+// scanAccount records the votes an account received since it was last
+// scanned, in a transaction of its own
+func scanAccount(ctx context.Context, conn *pgx.Conn, esplora *bitcoin.Esplora,
+	a *account, tip uint64, gapLimit uint32, rules *votes.Rules) error {
+	used, owned, err := addresses(ctx, esplora, a.Wallet, gapLimit)
+	if err != nil {
+		return err
+	}
+
+	// the most recent blocks are always fetched again, payments which were
+	// reorganised out of the chain get removed
+	scanned := uint64(0)
+	if a.ScannedHeight > rules.ReorgDepth {
+		scanned = a.ScannedHeight - rules.ReorgDepth
+	}
+	var (
+		txs    []*bitcoin.Transaction
+		seen   = make(map[string]bool)
+		hashes []string
+	)
+	for _, address := range used {
+		found, err := esplora.Transactions(ctx, address, scanned)
+		if err != nil {
+			return err
+		}
+		for _, t := range found {
+			// a transaction touching several addresses shows up for each
+			if seen[t.TxID] {
+				continue
+			}
+			seen[t.TxID] = true
+			txs = append(txs, t)
+			hashes = append(hashes, t.TxID)
+		}
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := votes.ClearPending(ctx, tx, a.ID); err != nil {
+		return err
+	}
+	if err := votes.Vanished(ctx, tx, a.ID, scanned+1, tip, hashes); err != nil {
+		return err
+	}
+
+	for _, t := range txs {
+		var received, sent uint64
+		for _, out := range t.Vout {
+			if owned[out.Address] {
+				received += out.Value
+			}
+		}
+		for _, in := range t.Vin {
+			if in.Prevout != nil && owned[in.Prevout.Address] {
+				sent += in.Prevout.Value
+			}
+		}
+		if received == 0 {
+			continue
+		}
+		date := time.Now().UTC()
+		height := uint64(0)
+		if t.Status.Confirmed {
+			date = time.Unix(t.Status.BlockTime, 0).UTC()
+			height = t.Status.BlockHeight
+		}
+		// locktime only delays mining, outputs are spendable once confirmed
+		verdict, err := rules.Apply(ctx, tx, &votes.Incoming{
+			Payment: votes.Payment{
+				AcceptedPaymentID: a.ID,
+				Address:           a.Address,
+				TxID:              t.TxID,
+				Date:              date,
+				Amount:            received,
+				Height:            height,
+			},
+			Sent:     sent,
+			Coinbase: t.Coinbase(),
+		}, tip+1)
+		if err != nil {
+			return err
+		}
+		log.Printf("Found %s BTC for account %d in tx %s: %s",
+			currency.Bitcoin.FormatUint(received), a.ID, t.TxID, verdict)
+	}
+
+	// everything with enough confirmations is settled, anything above
+	// is fetched again next time
+	scanHeight := a.ScannedHeight
+	if tip+1 > rules.Confirmations && tip+1-rules.Confirmations > scanHeight {
+		scanHeight = tip + 1 - rules.Confirmations
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE accepted_payments SET scan_height=$2, registered=true WHERE id = $1
+	`, a.ID, scanHeight); err != nil {
+		return err
+	}
+	// pending transactions were looked at too, all the way to the tip
+	if err := votes.Synced(ctx, tx, a.ID, tip, tip); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/t-900-a/gemmit/bitcoin"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// the extended public key of BIP32's first test vector
+const testXpub = "xpub661MyMwAqRbcFtXgS5sYJABqqG9YLmC4Q1Rdap9gSE8NqtwybGhePY2gZ29ESFjqJoCu1Rupje8YtGqsefD265TMg7usUDFdp6W1EGMcet8"
+
+func TestAddressesGapLimit(t *testing.T) {
+	w, err := bitcoin.ParseWallet(testXpub, &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derive := func(chain, index uint32) string {
+		address, err := w.Derive(chain, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return address
+	}
+
+	// receiving addresses 0, 3 and 7 were used, with a gap of 3 between
+	// 3 and 7, and change address 1
+	used := map[string]bool{
+		derive(bitcoin.External, 0): true,
+		derive(bitcoin.External, 3): true,
+		derive(bitcoin.External, 7): true,
+		derive(bitcoin.Internal, 1): true,
+	}
+	asked := make(map[string]bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		address := strings.TrimPrefix(r.URL.Path, "/address/")
+		asked[address] = true
+		count := 0
+		if used[address] {
+			count = 1
+		}
+		fmt.Fprintf(w, `{"chain_stats":{"tx_count":%d},"mempool_stats":{"tx_count":0}}`, count)
+	}))
+	defer srv.Close()
+	esplora, err := bitcoin.NewEsplora(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, owned, err := addresses(context.Background(), esplora, w, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		derive(bitcoin.External, 0), derive(bitcoin.External, 3),
+		derive(bitcoin.External, 7), derive(bitcoin.Internal, 1),
+	}
+	if strings.Join(found, " ") != strings.Join(want, " ") {
+		t.Errorf("got used addresses %v, want %v", found, want)
+	}
+	// derivation goes on until 4 unused addresses in a row: 8 to 11 on the
+	// external chain, 2 to 5 on the internal one
+	for chain, last := range map[uint32]uint32{bitcoin.External: 11, bitcoin.Internal: 5} {
+		for index := uint32(0); index <= last; index++ {
+			if address := derive(chain, index); !owned[address] || !asked[address] {
+				t.Errorf("address %d/%d was not derived", chain, index)
+			}
+		}
+		if address := derive(chain, last+1); owned[address] || asked[address] {
+			t.Errorf("address %d/%d is beyond the gap limit", chain, last+1)
+		}
+	}
+	if len(owned) != 12+6 {
+		t.Errorf("got %d owned addresses, want %d", len(owned), 18)
+	}
+
+	// a single address isn't derived from, or looked up
+	single, err := bitcoin.ParseWallet(derive(bitcoin.External, 0), &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	asked = make(map[string]bool)
+	found, owned, err = addresses(context.Background(), esplora, single, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || len(owned) != 1 || len(asked) != 0 {
+		t.Errorf("single address: got %v and %d owned after %d requests", found, len(owned), len(asked))
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/t-900-a/gemmit/cryptonote"
+	feeds "github.com/t-900-a/gemmit/feeds"
+	"github.com/t-900-a/gemmit/viewkeys"
+	"github.com/t-900-a/gemmit/votes"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+)
+
+// accounts that have never been scanned start this far behind the chain
+// tip, unless a start height is given
+const defaultLookback = 24 * time.Hour
+
+type account struct {
+	ID            int
+	Address       string
+	ScannedHeight uint64
+	Keys          *cryptonote.Account
+}
+
+func main() {
+	coinName := flag.String("coin", "monero", "CryptoNote coin to scan, monero or wownero")
+	rules := votes.DefaultRules(0) // the block time depends on the coin
+	rules.Flags(flag.CommandLine)
+	keyringPath := flag.String("view-keys", "",
+		"file with the private keys view keys are sealed to, $"+viewkeys.KeyringEnv+" if empty")
+	rescan := flag.Bool("rescan", false,
+		"compare the recorded votes with a scan of the blocks from -from on instead of scanning new ones")
+	only := flag.Int("account", 0, "accepted payment to rescan, all of them if 0")
+	from := flag.Uint64("from", 0, "height to rescan from")
+	repair := flag.Bool("repair", false,
+		"fix what the rescan finds and scan the accounts again from -from on the next run")
+	flag.Parse()
+	if *rescan && *from == 0 {
+		log.Fatal("-rescan needs -from, scanning the whole chain takes days")
+	}
+
+	coin := cryptonote.CoinByName(*coinName)
+	if coin == nil {
+		log.Fatalf("Unknown coin %s", *coinName)
+	}
+	rules.BlockTime = coin.BlockTime
+	if err := rules.SetCurrency(coin.Currency); err != nil {
+		log.Fatal(err)
+	}
+
+	keyring, err := viewkeys.LoadKeyring(*keyringPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := sql.Open("pgx", flag.Arg(0))
+	if err != nil {
+		panic(err)
+	}
+
+	daemonURL := coin.Daemon
+	if flag.NArg() > 1 {
+		daemonURL = flag.Arg(1)
+	}
+	daemon, err := cryptonote.NewDaemon(daemonURL)
+	if err != nil {
+		panic(err)
+	}
+
+	ctx := feeds.DBContext(context.TODO(), db)
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	if err := conn.Raw(func(driverConn interface{}) error {
+		conn := driverConn.(*stdlib.Conn).Conn()
+
+		tip, err := daemon.Height(ctx)
+		if err != nil {
+			return err
+		}
+		start := uint64(0)
+		if lookback := uint64(defaultLookback / coin.BlockTime); tip > lookback {
+			start = tip - lookback
+		}
+		if flag.NArg() > 2 {
+			start, err = strconv.ParseUint(flag.Arg(2), 10, 64)
+			if err != nil {
+				return err
+			}
+		}
+
+		accounts, err := loadAccounts(ctx, conn, coin, keyring, start)
+		if err != nil {
+			return err
+		}
+		if len(accounts) == 0 {
+			return nil
+		}
+
+		// blocks without enough confirmations only hold pending votes
+		if tip <= rules.Confirmations {
+			return nil
+		}
+		last := tip - rules.Confirmations
+
+		if *rescan {
+			var rescanned []*account
+			for _, a := range accounts {
+				if *only == 0 || a.ID == *only {
+					rescanned = append(rescanned, a)
+				}
+			}
+			return rescanAccounts(ctx, conn, coin, daemon, rules, rescanned, *from, last, tip, *repair)
+		}
+
+		// the most recent blocks are always scanned again, payments in
+		// blocks that were reorganised away get removed and payments in
+		// their replacements recorded
+		recheck := uint64(0)
+		if last > rules.ReorgDepth {
+			recheck = last - rules.ReorgDepth
+		}
+		from := accounts[0].ScannedHeight + 1
+		for _, a := range accounts {
+			if a.ScannedHeight > recheck {
+				a.ScannedHeight = recheck
+			}
+			if a.ScannedHeight+1 < from {
+				from = a.ScannedHeight + 1
+			}
+		}
+
+		log.Printf("Scanning blocks %d to %d for %d accounts", from, last, len(accounts))
+		for height := from; height <= last; height++ {
+			block, err := daemon.Block(ctx, height)
+			if err != nil {
+				return err
+			}
+			if err := scanBlock(ctx, conn, coin, block, tip, rules, accounts); err != nil {
+				return err
+			}
+		}
+
+		return scanPending(ctx, conn, coin, daemon, last+1, tip, rules, accounts)
+	}); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func loadAccounts(ctx context.Context, conn *pgx.Conn, coin *cryptonote.Coin, keyring *viewkeys.Keyring, start uint64) ([]*account, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT id, view_key, address, COALESCE(scan_height, 0)
+		FROM accepted_payments
+		WHERE pay_type = $1 AND view_key <> '' AND retired IS NULL;
+	`, coin.Currency.PayType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []*account
+	for rows.Next() {
+		var (
+			a       account
+			viewKey string
+		)
+		if err := rows.Scan(&a.ID, &viewKey, &a.Address, &a.ScannedHeight); err != nil {
+			return nil, err
+		}
+		if viewKey, err = keyring.Open(viewKey); err != nil {
+			log.Printf("Skipping account %d: %v", a.ID, err)
+			continue
+		}
+		addr, err := coin.DecodeAddress(a.Address)
+		if err != nil {
+			log.Printf("Skipping account %d: %v", a.ID, err)
+			continue
+		}
+		secret, err := cryptonote.ParseSecretKey(viewKey)
+		if err != nil {
+			log.Printf("Skipping account %d: %v", a.ID, err)
+			continue
+		}
+		a.Keys = &cryptonote.Account{
+			ViewSecret: secret,
+			SpendPub:   addr.SpendPub,
+		}
+		if a.ScannedHeight == 0 && start > 0 {
+			a.ScannedHeight = start - 1
+		}
+		accounts = append(accounts, &a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, a := range accounts {
+		entries, err := votes.EntryAddresses(ctx, conn, a.ID)
+		if err != nil {
+			return nil, err
+		}
+		for address, id := range entries {
+			addr, err := coin.DecodeAddress(address)
+			if err == nil {
+				err = a.Keys.AddAddress(addr, id)
+			}
+			if err != nil {
+				log.Printf("Skipping address of entry %d: %v", id, err)
+			}
+		}
+	}
+	return accounts, nil
+}
+
+// scanBlock records the outputs in block belonging to each account and
+// advances the account's scan height, all in one transaction so that an
+// interrupted scan picks up where it left off
+func scanBlock(ctx context.Context, conn *pgx.Conn, coin *cryptonote.Coin, block *cryptonote.Block,
+	tip uint64, rules *votes.Rules, accounts []*account) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	hashes := make([]string, 0, len(block.Transactions))
+	for _, t := range block.Transactions {
+		hashes = append(hashes, t.Hash)
+	}
+
+	for _, a := range accounts {
+		if a.ScannedHeight >= block.Height {
+			continue
+		}
+		if err := votes.Vanished(ctx, tx, a.ID, block.Height, block.Height, hashes); err != nil {
+			return err
+		}
+		if err := scanTransactions(ctx, tx, coin, a, block.Transactions,
+			block.Timestamp, block.Height, tip, rules); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `
+			UPDATE accepted_payments SET scan_height=$2 WHERE id = $1
+		`, a.ID, block.Height); err != nil {
+			return err
+		}
+		// tip counts the blocks, the last one is a height below
+		if err := votes.Synced(ctx, tx, a.ID, block.Height, tip-1); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	for _, a := range accounts {
+		if a.ScannedHeight < block.Height {
+			a.ScannedHeight = block.Height
+		}
+	}
+	return nil
+}
+
+// scanPending records the votes in blocks that don't have enough
+// confirmations yet and in the mempool as pending. They're recorded from
+// scratch on every scan, whatever vanished since the last one is gone.
+func scanPending(ctx context.Context, conn *pgx.Conn, coin *cryptonote.Coin, daemon *cryptonote.Daemon,
+	from, tip uint64, rules *votes.Rules, accounts []*account) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, a := range accounts {
+		if err := votes.ClearPending(ctx, tx, a.ID); err != nil {
+			return err
+		}
+	}
+
+	for height := from; height < tip; height++ {
+		block, err := daemon.Block(ctx, height)
+		if err != nil {
+			return err
+		}
+		for _, a := range accounts {
+			if err := scanTransactions(ctx, tx, coin, a, block.Transactions,
+				block.Timestamp, block.Height, tip, rules); err != nil {
+				return err
+			}
+		}
+	}
+
+	pool, err := daemon.Pool(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, a := range accounts {
+		if err := scanTransactions(ctx, tx, coin, a, pool, now, 0, tip, rules); err != nil {
+			return err
+		}
+		if err := votes.Synced(ctx, tx, a.ID, tip-1, tip-1); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+func scanTransactions(ctx context.Context, tx pgx.Tx, coin *cryptonote.Coin, a *account, txs []*cryptonote.Transaction,
+	date time.Time, height, tip uint64, rules *votes.Rules) error {
+	for _, t := range txs {
+		in, err := incoming(a, t, date, height)
+		if err != nil {
+			log.Printf("Failed to scan tx %s: %v", t.Hash, err)
+			continue
+		}
+		if in == nil {
+			continue
+		}
+		verdict, err := rules.Apply(ctx, tx, in, tip)
+		if err != nil {
+			return err
+		}
+		log.Printf("Found %s %s for account %d in tx %s: %s",
+			coin.Currency.FormatUint(in.Amount), coin.Currency.Ticker, a.ID, t.Hash, verdict)
+	}
+	return nil
+}
+
+// incoming is what t pays to the account, nil if nothing
+func incoming(a *account, t *cryptonote.Transaction, date time.Time, height uint64) (*votes.Incoming, error) {
+	outputs, err := a.Keys.Scan(t)
+	if err != nil || len(outputs) == 0 {
+		return nil, err
+	}
+	// a transaction paying several entries at once is a vote for
+	// whichever received the most
+	var received uint64
+	perEntry := make(map[int]uint64)
+	for _, o := range outputs {
+		received += o.Amount
+		perEntry[o.ID] += o.Amount
+	}
+	entryID := 0
+	for id, amount := range perEntry {
+		if id != 0 && amount > perEntry[entryID] {
+			entryID = id
+		}
+	}
+	// a view key can't see key images, so outgoing amounts are
+	// unknown and change from the author's own spends counts
+	return &votes.Incoming{
+		Payment: votes.Payment{
+			AcceptedPaymentID: a.ID,
+			Address:           a.Address,
+			TxID:              t.Hash,
+			Date:              date,
+			Amount:            received,
+			Height:            height,
+			EntryID:           entryID,
+		},
+		Coinbase:   t.Coinbase(),
+		UnlockTime: t.UnlockTime,
+	}, nil
+}
+
+// rescanAccounts compares the payments recorded for the accounts from
+// height from on with a scan of the blocks up to last, the last one with
+// enough confirmations. Unlike a light wallet server's history the scan
+// sees subaddresses and which entry each vote was for. Nothing is changed
+// unless repair is set, every account is then repaired in a transaction of
+// its own.
+func rescanAccounts(ctx context.Context, conn *pgx.Conn, coin *cryptonote.Coin, daemon *cryptonote.Daemon,
+	rules *votes.Rules, accounts []*account, from, last, tip uint64, repair bool) error {
+	scanned := make(map[int][]*votes.Incoming)
+	log.Printf("Rescanning blocks %d to %d for %d accounts", from, last, len(accounts))
+	for height := from; height <= last; height++ {
+		block, err := daemon.Block(ctx, height)
+		if err != nil {
+			return err
+		}
+		for _, a := range accounts {
+			for _, t := range block.Transactions {
+				in, err := incoming(a, t, block.Timestamp, block.Height)
+				if err != nil {
+					log.Printf("Failed to scan tx %s: %v", t.Hash, err)
+					continue
+				}
+				if in != nil {
+					scanned[a.ID] = append(scanned[a.ID], in)
+				}
+			}
+		}
+	}
+
+	for _, a := range accounts {
+		if err := reconcileAccount(ctx, conn, coin, rules, a, scanned[a.ID], from, tip, repair); err != nil {
+			log.Printf("Failed to rescan %s account %d: %v", coin.Name, a.ID, err)
+		}
+	}
+	return nil
+}
+
+func reconcileAccount(ctx context.Context, conn *pgx.Conn, coin *cryptonote.Coin, rules *votes.Rules,
+	a *account, scanned []*votes.Incoming, from, tip uint64, repair bool) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	found, err := rules.Reconcile(ctx, tx, a.ID, from, scanned, tip, votes.AllPayments)
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		log.Printf("%s account %d matches the chain from height %d", coin.Name, a.ID, from)
+	}
+	for _, d := range found {
+		log.Printf("%s account %d: %s", coin.Name, a.ID, d)
+	}
+	if !repair {
+		return nil
+	}
+
+	for _, d := range found {
+		if err := rules.Repair(ctx, tx, d, tip); err != nil {
+			return err
+		}
+	}
+	// the blocks since are scanned again on the next run
+	if _, err := tx.Exec(ctx, `
+		UPDATE accepted_payments SET scan_height = LEAST(COALESCE(scan_height, 0), $2)
+		WHERE id = $1
+	`, a.ID, from-1); err != nil {
+		return err
+	}
+	log.Printf("Repaired %d payments of %s account %d", len(found), coin.Name, a.ID)
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,147 @@
+// viewkeys manages the keys view keys are sealed to.
+//
+//	viewkeys generate
+//	viewkeys [-view-keys file] reseal <db>
+//
+// generate prints a new key pair. reseal seals every stored view key to the
+// first key of the keyring, encrypting those stored before encryption was
+// set up and those sealed to older keys. It also checks every view key opens
+// its address, authors are only matched by checked ones.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/t-900-a/gemmit/cryptonote"
+	feeds "github.com/t-900-a/gemmit/feeds"
+	"github.com/t-900-a/gemmit/viewkeys"
+
+	"github.com/jackc/pgx/v4/stdlib"
+)
+
+func main() {
+	keyringPath := flag.String("view-keys", "",
+		"file with the private keys view keys are sealed to, $"+viewkeys.KeyringEnv+" if empty")
+	flag.Parse()
+
+	switch flag.Arg(0) {
+	case "generate":
+		public, private, err := viewkeys.GenerateKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("# public key, set as $%s for gemmit\n# %s\n%s\n", viewkeys.PublicKeyEnv, public, private)
+	case "reseal":
+		keyring, err := viewkeys.LoadKeyring(*keyringPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := reseal(flag.Arg(1), keyring); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatal("Usage: viewkeys generate | viewkeys [-view-keys file] reseal <db>")
+	}
+}
+
+func reseal(dsn string, keyring *viewkeys.Keyring) error {
+	to := keyring.Current()
+	if to == nil {
+		return fmt.Errorf("No keys, give a keyring file or set $%s", viewkeys.KeyringEnv)
+	}
+
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return err
+	}
+	ctx := feeds.DBContext(context.TODO(), db)
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		conn := driverConn.(*stdlib.Conn).Conn()
+
+		// all or nothing, the old keys can be dropped once this committed
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		rows, err := tx.Query(ctx, `
+			SELECT id, pay_type, address, view_key FROM accepted_payments
+			WHERE view_key IS NOT NULL AND view_key <> ''
+			FOR UPDATE;
+		`)
+		if err != nil {
+			return err
+		}
+		type account struct {
+			PayType, Address, ViewKey string
+		}
+		stored := make(map[int]*account)
+		for rows.Next() {
+			var (
+				id int
+				a  account
+			)
+			if err := rows.Scan(&id, &a.PayType, &a.Address, &a.ViewKey); err != nil {
+				rows.Close()
+				return err
+			}
+			stored[id] = &a
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		unchecked := 0
+		for id, a := range stored {
+			sealed, err := keyring.Reseal(a.ViewKey, to)
+			if err != nil {
+				return fmt.Errorf("Account %d: %v", id, err)
+			}
+			viewKey, err := keyring.Open(a.ViewKey)
+			if err != nil {
+				return fmt.Errorf("Account %d: %v", id, err)
+			}
+			checked := opens(a.PayType, a.Address, viewKey)
+			if !checked {
+				log.Printf("Account %d: the view key doesn't open %s", id, a.Address)
+				unchecked++
+			}
+			if _, err := tx.Exec(ctx, `
+				UPDATE accepted_payments SET view_key = $2, view_key_checked = $3 WHERE id = $1
+			`, id, sealed, checked); err != nil {
+				return err
+			}
+		}
+		log.Printf("Sealed %d view keys to %s, %d don't open their address", len(stored), to.ID(), unchecked)
+		return tx.Commit(ctx)
+	})
+}
+
+// opens tells if viewKey is the private view key of a CryptoNote address
+func opens(payType, address, viewKey string) bool {
+	coin := cryptonote.CoinForPayType(payType)
+	if coin == nil {
+		return false
+	}
+	addr, err := coin.DecodeAddress(address)
+	if err != nil {
+		return false
+	}
+	secret, err := cryptonote.ParseSecretKey(viewKey)
+	if err != nil {
+		return false
+	}
+	return addr.MatchesViewKey(secret)
+}
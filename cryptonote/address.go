@@ -0,0 +1,168 @@
+package cryptonote
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"filippo.io/edwards25519"
+)
+
+type AddressKind int
+
+const (
+	StandardAddress AddressKind = iota
+	IntegratedAddress
+	Subaddress
+)
+
+func (k AddressKind) String() string {
+	switch k {
+	case StandardAddress:
+		return "standard address"
+	case IntegratedAddress:
+		return "integrated address"
+	case Subaddress:
+		return "subaddress"
+	default:
+		return "unknown address"
+	}
+}
+
+// Network holds the varint prefixes that begin each kind of address
+type Network struct {
+	Name       string
+	Standard   uint64
+	Integrated uint64
+	Subaddress uint64
+}
+
+var (
+	MoneroMainnet  = &Network{"mainnet", 18, 19, 42}
+	MoneroTestnet  = &Network{"testnet", 53, 54, 63}
+	MoneroStagenet = &Network{"stagenet", 24, 25, 36}
+
+	// Only mainnet for Wownero, the test networks' prefixes are unconfirmed
+	WowneroMainnet = &Network{"mainnet", 4146, 6810, 12208}
+)
+
+const (
+	checksumSize  = 4
+	paymentIDSize = 8
+)
+
+// Address holds the public keys encoded in a wallet address
+type Address struct {
+	Network   *Network
+	Kind      AddressKind
+	SpendPub  Key
+	ViewPub   Key
+	PaymentID []byte
+}
+
+var (
+	ErrInvalidAddress  = errors.New("Invalid address")
+	ErrAddressChecksum = errors.New("Address checksum mismatch")
+)
+
+// DecodeAddress parses and validates an address on one of networks. Forks
+// reuse each other's prefixes, so the coin has to be known beforehand.
+func DecodeAddress(s string, networks []*Network) (*Address, error) {
+	data, err := DecodeBase58(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < checksumSize {
+		return nil, ErrInvalidAddress
+	}
+	body, checksum := data[:len(data)-checksumSize], data[len(data)-checksumSize:]
+	if !bytes.Equal(Keccak256(body)[:checksumSize], checksum) {
+		return nil, ErrAddressChecksum
+	}
+
+	tag, l := binary.Uvarint(body)
+	if l <= 0 {
+		return nil, ErrInvalidAddress
+	}
+	a := &Address{}
+	for _, n := range networks {
+		if kind, ok := n.kind(tag); ok {
+			a.Network, a.Kind = n, kind
+			break
+		}
+	}
+	if a.Network == nil {
+		return nil, fmt.Errorf("Unknown address prefix %d", tag)
+	}
+
+	body = body[l:]
+	size := 64
+	if a.Kind == IntegratedAddress {
+		size += paymentIDSize
+	}
+	if len(body) != size {
+		return nil, ErrInvalidAddress
+	}
+	copy(a.SpendPub[:], body[:32])
+	copy(a.ViewPub[:], body[32:64])
+	if a.Kind == IntegratedAddress {
+		a.PaymentID = body[64:]
+	}
+	if _, err := ParsePublicKey(a.SpendPub); err != nil {
+		return nil, ErrInvalidAddress
+	}
+	if _, err := ParsePublicKey(a.ViewPub); err != nil {
+		return nil, ErrInvalidAddress
+	}
+	return a, nil
+}
+
+func (n *Network) kind(prefix uint64) (AddressKind, bool) {
+	switch prefix {
+	case n.Standard:
+		return StandardAddress, true
+	case n.Integrated:
+		return IntegratedAddress, true
+	case n.Subaddress:
+		return Subaddress, true
+	}
+	return 0, false
+}
+
+func (a *Address) prefix() uint64 {
+	switch a.Kind {
+	case IntegratedAddress:
+		return a.Network.Integrated
+	case Subaddress:
+		return a.Network.Subaddress
+	default:
+		return a.Network.Standard
+	}
+}
+
+func (a *Address) String() string {
+	data := putUvarint(a.prefix())
+	data = append(data, a.SpendPub[:]...)
+	data = append(data, a.ViewPub[:]...)
+	if a.Kind == IntegratedAddress {
+		data = append(data, a.PaymentID...)
+	}
+	data = append(data, Keccak256(data)[:checksumSize]...)
+	return EncodeBase58(data)
+}
+
+// MatchesViewKey reports whether the private view key belongs to the
+// address. For a subaddress the view public key is aD rather than aG.
+func (a *Address) MatchesViewKey(viewSecret *edwards25519.Scalar) bool {
+	if a.Kind != Subaddress {
+		return PublicFromSecret(viewSecret) == a.ViewPub
+	}
+	D, err := ParsePublicKey(a.SpendPub)
+	if err != nil {
+		return false
+	}
+	var C Key
+	copy(C[:], edwards25519.NewIdentityPoint().ScalarMult(viewSecret, D).Bytes())
+	return C == a.ViewPub
+}
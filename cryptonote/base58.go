@@ -0,0 +1,98 @@
+package cryptonote
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"strings"
+)
+
+// Monero's base58 encodes 8 byte blocks into 11 characters each, rather
+// than treating the whole input as one big number like bitcoin does.
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+const (
+	fullBlockSize        = 8
+	fullEncodedBlockSize = 11
+)
+
+var encodedBlockSizes = []int{0, 2, 3, 5, 6, 7, 9, 10, 11}
+
+var ErrInvalidBase58 = errors.New("Invalid base58 string")
+
+func DecodeBase58(s string) ([]byte, error) {
+	fullBlocks := len(s) / fullEncodedBlockSize
+	lastEncoded := len(s) % fullEncodedBlockSize
+	lastSize := -1
+	for size, encoded := range encodedBlockSizes {
+		if encoded == lastEncoded {
+			lastSize = size
+		}
+	}
+	if lastSize < 0 {
+		return nil, ErrInvalidBase58
+	}
+
+	out := make([]byte, 0, fullBlocks*fullBlockSize+lastSize)
+	for i := 0; i < fullBlocks; i++ {
+		block := s[i*fullEncodedBlockSize : (i+1)*fullEncodedBlockSize]
+		b, err := decodeBlock(block, fullBlockSize)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b...)
+	}
+	if lastEncoded > 0 {
+		b, err := decodeBlock(s[fullBlocks*fullEncodedBlockSize:], lastSize)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b...)
+	}
+	return out, nil
+}
+
+func decodeBlock(block string, size int) ([]byte, error) {
+	var num uint64
+	for _, c := range []byte(block) {
+		digit := strings.IndexByte(base58Alphabet, c)
+		if digit < 0 {
+			return nil, ErrInvalidBase58
+		}
+		hi, lo := bits.Mul64(num, 58)
+		if hi != 0 {
+			return nil, ErrInvalidBase58
+		}
+		var carry uint64
+		num, carry = bits.Add64(lo, uint64(digit), 0)
+		if carry != 0 {
+			return nil, ErrInvalidBase58
+		}
+	}
+	if size < fullBlockSize && num>>(8*uint(size)) != 0 {
+		return nil, ErrInvalidBase58
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], num)
+	return buf[fullBlockSize-size:], nil
+}
+
+func EncodeBase58(data []byte) string {
+	var sb strings.Builder
+	for i := 0; i < len(data); i += fullBlockSize {
+		end := i + fullBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		var buf [8]byte
+		copy(buf[fullBlockSize-(end-i):], data[i:end])
+		num := binary.BigEndian.Uint64(buf[:])
+		encoded := make([]byte, encodedBlockSizes[end-i])
+		for j := len(encoded) - 1; j >= 0; j-- {
+			encoded[j] = base58Alphabet[num%58]
+			num /= 58
+		}
+		sb.Write(encoded)
+	}
+	return sb.String()
+}
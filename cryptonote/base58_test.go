@@ -0,0 +1,96 @@
+package cryptonote
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestBase58(t *testing.T) {
+	var cases []struct {
+		Hex    string `json:"hex"`
+		Base58 string `json:"base58"`
+	}
+	loadFixture(t, "base58.json", &cases)
+
+	for _, c := range cases {
+		data, err := hex.DecodeString(c.Hex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := EncodeBase58(data); s != c.Base58 {
+			t.Errorf("encoding %s: got %q, want %q", c.Hex, s, c.Base58)
+		}
+		decoded, err := DecodeBase58(c.Base58)
+		if err != nil {
+			t.Errorf("decoding %q: %v", c.Base58, err)
+			continue
+		}
+		if hex.EncodeToString(decoded) != c.Hex {
+			t.Errorf("decoding %q: got %x, want %s", c.Base58, decoded, c.Hex)
+		}
+	}
+
+	// a trailing block can't be 1, 4 or 8 characters long
+	for _, s := range []string{"1", "1111", "11111111", "0OIl"} {
+		if _, err := DecodeBase58(s); err == nil {
+			t.Errorf("decoding %q: no error", s)
+		}
+	}
+}
+
+func TestAddresses(t *testing.T) {
+	var cases []struct {
+		Coin        string `json:"coin"`
+		Network     string `json:"network"`
+		Kind        string `json:"kind"`
+		Address     string `json:"address"`
+		SpendPublic string `json:"spend_public"`
+		ViewPublic  string `json:"view_public"`
+		ViewSecret  string `json:"view_secret"`
+		PaymentID   string `json:"payment_id"`
+	}
+	loadFixture(t, "addresses.json", &cases)
+
+	for _, c := range cases {
+		addr, err := CoinByName(c.Coin).DecodeAddress(c.Address)
+		if err != nil {
+			t.Errorf("%s: %v", c.Address, err)
+			continue
+		}
+		if addr.Network.Name != c.Network || addr.Kind.String() != c.Kind {
+			t.Errorf("%s: got a %s %s, want a %s %s", c.Address,
+				addr.Network.Name, addr.Kind, c.Network, c.Kind)
+		}
+		if addr.SpendPub.String() != c.SpendPublic || addr.ViewPub.String() != c.ViewPublic {
+			t.Errorf("%s: got keys %s %s, want %s %s", c.Address,
+				addr.SpendPub, addr.ViewPub, c.SpendPublic, c.ViewPublic)
+		}
+		if hex.EncodeToString(addr.PaymentID) != c.PaymentID {
+			t.Errorf("%s: got payment ID %x, want %q", c.Address, addr.PaymentID, c.PaymentID)
+		}
+		if s := addr.String(); s != c.Address {
+			t.Errorf("%s: encoded again as %s", c.Address, s)
+		}
+		viewSecret, err := ParseSecretKey(c.ViewSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !addr.MatchesViewKey(viewSecret) {
+			t.Errorf("%s: the view key doesn't match", c.Address)
+		}
+		if addr.MatchesViewKey(HashToScalar(viewSecret.Bytes())) {
+			t.Errorf("%s: another view key matches", c.Address)
+		}
+
+		// a single changed character breaks the checksum
+		broken := []byte(c.Address)
+		if broken[20] == 'a' {
+			broken[20] = 'b'
+		} else {
+			broken[20] = 'a'
+		}
+		if _, err := CoinByName(c.Coin).DecodeAddress(string(broken)); err == nil {
+			t.Errorf("%s: decoded with a changed character", broken)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package cryptonote
+
+import (
+	"strings"
+	"time"
+
+	"github.com/t-900-a/gemmit/currency"
+)
+
+// Coin holds what differs between Monero and its forks, everything else
+// in this package works for all of them
+type Coin struct {
+	Name     string
+	Currency *currency.Currency
+	// Network is where votes are accepted, Networks are all the networks
+	// of the coin so addresses on the wrong one can be told apart
+	Network  *Network
+	Networks []*Network
+	// URIScheme prefixes addresses in payment links, e.g. monero:
+	URIScheme string
+	BlockTime time.Duration
+	// default endpoints of the scanners
+	Daemon      string
+	LightWallet string
+}
+
+var (
+	Monero = &Coin{
+		Name:        "Monero",
+		Currency:    currency.Monero,
+		Network:     MoneroMainnet,
+		Networks:    []*Network{MoneroMainnet, MoneroTestnet, MoneroStagenet},
+		URIScheme:   "monero",
+		BlockTime:   2 * time.Minute,
+		Daemon:      "http://127.0.0.1:18081",
+		LightWallet: "https://api.mymonero.com:8443",
+	}
+	Wownero = &Coin{
+		Name:      "Wownero",
+		Currency:  currency.Wownero,
+		Network:   WowneroMainnet,
+		Networks:  []*Network{WowneroMainnet},
+		URIScheme: "wownero",
+		BlockTime: 5 * time.Minute,
+		Daemon:    "http://127.0.0.1:34568",
+	}
+
+	Coins = []*Coin{Monero, Wownero}
+)
+
+// CoinByName finds a coin by its name, ignoring case
+func CoinByName(name string) *Coin {
+	for _, c := range Coins {
+		if strings.EqualFold(c.Name, name) {
+			return c
+		}
+	}
+	return nil
+}
+
+// CoinForPayType finds the coin of a payment request extension type, nil
+// if it isn't a CryptoNote coin
+func CoinForPayType(payType string) *Coin {
+	for _, c := range Coins {
+		if c.Currency.PayType == payType {
+			return c
+		}
+	}
+	return nil
+}
+
+// ViewKeyType is the extension type the private view key is published
+// with, e.g. application/monero-viewkey
+func (c *Coin) ViewKeyType() string {
+	return strings.TrimSuffix(c.Currency.PayType, "-paymentrequest") + "-viewkey"
+}
+
+// DecodeAddress parses an address on any of the coin's networks
+func (c *Coin) DecodeAddress(s string) (*Address, error) {
+	return DecodeAddress(s, c.Networks)
+}
@@ -0,0 +1,250 @@
+package cryptonote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Daemon talks to the JSON RPC interface of a monerod (or compatible) node
+type Daemon struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewDaemon(rawurl string) (*Daemon, error) {
+	if _, err := url.ParseRequestURI(rawurl); err != nil {
+		return nil, err
+	}
+	return &Daemon{
+		URL: rawurl,
+		Client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}, nil
+}
+
+// Block is a block along with the full transactions it contains
+type Block struct {
+	Height       uint64
+	Hash         string
+	Timestamp    time.Time
+	Transactions []*Transaction
+}
+
+func (d *Daemon) post(ctx context.Context, method string, in, out interface{}) error {
+	u, err := url.ParseRequestURI(d.URL)
+	if err != nil {
+		return err
+	}
+	u.Path = method
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("User-Agent", "gemmit (https://github.com/t-900-a/gemmit)")
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected daemon response %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1073741824)) // 1 GiB
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, out)
+}
+
+func (d *Daemon) call(ctx context.Context, method string, params, result interface{}) error {
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := d.post(ctx, "/json_rpc", map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      "0",
+		"method":  method,
+		"params":  params,
+	}, &resp); err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("Daemon error %d: %s", resp.Error.Code, resp.Error.Message)
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// Height returns the number of blocks in the daemon's chain
+func (d *Daemon) Height(ctx context.Context) (uint64, error) {
+	var result struct {
+		Count  uint64 `json:"count"`
+		Status string `json:"status"`
+	}
+	if err := d.call(ctx, "get_block_count", struct{}{}, &result); err != nil {
+		return 0, err
+	}
+	if result.Status != "OK" {
+		return 0, fmt.Errorf("Daemon status %s", result.Status)
+	}
+	return result.Count, nil
+}
+
+type blockResult struct {
+	BlockHeader struct {
+		Hash      string `json:"hash"`
+		Height    uint64 `json:"height"`
+		Timestamp int64  `json:"timestamp"`
+	} `json:"block_header"`
+	JSON        string   `json:"json"`
+	MinerTxHash string   `json:"miner_tx_hash"`
+	TxHashes    []string `json:"tx_hashes"`
+	Status      string   `json:"status"`
+}
+
+func (d *Daemon) getBlock(ctx context.Context, height uint64) (*blockResult, error) {
+	var result blockResult
+	if err := d.call(ctx, "get_block", map[string]uint64{
+		"height": height,
+	}, &result); err != nil {
+		return nil, err
+	}
+	if result.Status != "OK" {
+		return nil, fmt.Errorf("Daemon status %s", result.Status)
+	}
+	return &result, nil
+}
+
+// Block fetches the block at height along with its miner transaction and
+// all other transactions
+func (d *Daemon) Block(ctx context.Context, height uint64) (*Block, error) {
+	result, err := d.getBlock(ctx, height)
+	if err != nil {
+		return nil, err
+	}
+
+	var body struct {
+		MinerTx Transaction `json:"miner_tx"`
+	}
+	if err := json.Unmarshal([]byte(result.JSON), &body); err != nil {
+		return nil, err
+	}
+	body.MinerTx.Hash = result.MinerTxHash
+
+	block := &Block{
+		Height:       result.BlockHeader.Height,
+		Hash:         result.BlockHeader.Hash,
+		Timestamp:    time.Unix(result.BlockHeader.Timestamp, 0).UTC(),
+		Transactions: []*Transaction{&body.MinerTx},
+	}
+	if len(result.TxHashes) == 0 {
+		return block, nil
+	}
+	txs, err := d.Transactions(ctx, result.TxHashes)
+	if err != nil {
+		return nil, err
+	}
+	block.Transactions = append(block.Transactions, txs...)
+	return block, nil
+}
+
+// TxHashes lists the hashes of all transactions in the block at height,
+// including the miner transaction
+func (d *Daemon) TxHashes(ctx context.Context, height uint64) ([]string, error) {
+	result, err := d.getBlock(ctx, height)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{result.MinerTxHash}, result.TxHashes...), nil
+}
+
+// Pool fetches the transactions waiting in the daemon's mempool
+func (d *Daemon) Pool(ctx context.Context) ([]*Transaction, error) {
+	var result struct {
+		Transactions []struct {
+			IDHash string `json:"id_hash"`
+			TxJSON string `json:"tx_json"`
+		} `json:"transactions"`
+		Status string `json:"status"`
+	}
+	if err := d.post(ctx, "/get_transaction_pool", struct{}{}, &result); err != nil {
+		return nil, err
+	}
+	if result.Status != "OK" {
+		return nil, fmt.Errorf("Daemon status %s", result.Status)
+	}
+
+	txs := make([]*Transaction, 0, len(result.Transactions))
+	for _, t := range result.Transactions {
+		tx := &Transaction{}
+		if err := json.Unmarshal([]byte(t.TxJSON), tx); err != nil {
+			return nil, err
+		}
+		tx.Hash = t.IDHash
+		txs = append(txs, tx)
+	}
+	return txs, nil
+}
+
+// transactionsBatch is how many transactions are asked for at once, public
+// daemons refuse much larger requests
+const transactionsBatch = 100
+
+// Transactions fetches and decodes transactions by hash
+func (d *Daemon) Transactions(ctx context.Context, hashes []string) ([]*Transaction, error) {
+	txs := make([]*Transaction, 0, len(hashes))
+	for len(hashes) > 0 {
+		batch := hashes
+		if len(batch) > transactionsBatch {
+			batch = batch[:transactionsBatch]
+		}
+		hashes = hashes[len(batch):]
+
+		var result struct {
+			Txs []struct {
+				TxHash string `json:"tx_hash"`
+				AsJSON string `json:"as_json"`
+			} `json:"txs"`
+			MissedTx []string `json:"missed_tx"`
+			Status   string   `json:"status"`
+		}
+		if err := d.post(ctx, "/get_transactions", map[string]interface{}{
+			"txs_hashes":     batch,
+			"decode_as_json": true,
+		}, &result); err != nil {
+			return nil, err
+		}
+		if result.Status != "OK" {
+			return nil, fmt.Errorf("Daemon status %s", result.Status)
+		}
+		if len(result.MissedTx) > 0 {
+			return nil, fmt.Errorf("Daemon is missing %d transactions", len(result.MissedTx))
+		}
+
+		for _, t := range result.Txs {
+			tx := &Transaction{}
+			if err := json.Unmarshal([]byte(t.AsJSON), tx); err != nil {
+				return nil, err
+			}
+			tx.Hash = t.TxHash
+			txs = append(txs, tx)
+		}
+	}
+	return txs, nil
+}
@@ -0,0 +1,131 @@
+package cryptonote
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+
+	"filippo.io/edwards25519"
+	"golang.org/x/crypto/sha3"
+)
+
+// Key is a 32 byte public key, secret key or key derivation
+type Key [32]byte
+
+func ParseKey(s string) (Key, error) {
+	var k Key
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return k, err
+	}
+	if len(b) != len(k) {
+		return k, errors.New("Key must be 32 bytes")
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
+func (k Key) String() string {
+	return hex.EncodeToString(k[:])
+}
+
+func Keccak256(data ...[]byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// HashToScalar is keccak256 reduced mod l, what monero calls Hs
+func HashToScalar(data ...[]byte) *edwards25519.Scalar {
+	var wide [64]byte
+	copy(wide[:], Keccak256(data...))
+	return edwards25519.NewScalar().SetUniformBytes(wide[:])
+}
+
+func ParseSecretKey(s string) (*edwards25519.Scalar, error) {
+	k, err := ParseKey(s)
+	if err != nil {
+		return nil, err
+	}
+	return edwards25519.NewScalar().SetCanonicalBytes(k[:])
+}
+
+func ParsePublicKey(k Key) (*edwards25519.Point, error) {
+	return new(edwards25519.Point).SetBytes(k[:])
+}
+
+func PublicFromSecret(secret *edwards25519.Scalar) Key {
+	var k Key
+	copy(k[:], new(edwards25519.Point).ScalarBaseMult(secret).Bytes())
+	return k
+}
+
+// GenerateKeyDerivation computes D = 8aR for a tx public key R and private view key a
+func GenerateKeyDerivation(txPub Key, viewSecret *edwards25519.Scalar) (Key, error) {
+	var d Key
+	R, err := ParsePublicKey(txPub)
+	if err != nil {
+		return d, err
+	}
+	// ScalarMult in this version of edwards25519 adds into its receiver,
+	// so it has to start out as the identity
+	D := edwards25519.NewIdentityPoint().ScalarMult(viewSecret, R)
+	D.MultByCofactor(D)
+	copy(d[:], D.Bytes())
+	return d, nil
+}
+
+// DerivationToScalar is Hs(D || varint(index)), the shared secret for one output
+func DerivationToScalar(derivation Key, index uint64) *edwards25519.Scalar {
+	return HashToScalar(derivation[:], putUvarint(index))
+}
+
+// DerivePublicKey computes the one-time output key Hs(D || index)G + B
+func DerivePublicKey(derivation Key, index uint64, spendPub Key) (Key, error) {
+	var k Key
+	B, err := ParsePublicKey(spendPub)
+	if err != nil {
+		return k, err
+	}
+	P := new(edwards25519.Point).ScalarBaseMult(DerivationToScalar(derivation, index))
+	P.Add(P, B)
+	copy(k[:], P.Bytes())
+	return k, nil
+}
+
+// ViewTag is the first byte of keccak256("view_tag" || D || varint(index))
+func ViewTag(derivation Key, index uint64) byte {
+	return Keccak256([]byte("view_tag"), derivation[:], putUvarint(index))[0]
+}
+
+func putUvarint(v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return buf[:binary.PutUvarint(buf, v)]
+}
+
+// DeriveSubaddressPublicKey is the inverse of DerivePublicKey, it recovers
+// the spend public key P - Hs(D || index)G an output was sent to
+func DeriveSubaddressPublicKey(outKey Key, derivation Key, index uint64) (Key, error) {
+	var k Key
+	P, err := ParsePublicKey(outKey)
+	if err != nil {
+		return k, err
+	}
+	B := new(edwards25519.Point).ScalarBaseMult(DerivationToScalar(derivation, index))
+	B.Subtract(P, B)
+	copy(k[:], B.Bytes())
+	return k, nil
+}
+
+// DecryptPaymentID undoes the xor with keccak256(D || 0x8d) senders apply
+// to the short payment ID of an integrated address
+func DecryptPaymentID(encrypted []byte, derivation Key) []byte {
+	pad := Keccak256(derivation[:], []byte{0x8d})
+	id := make([]byte, len(encrypted))
+	for i := range encrypted {
+		id[i] = encrypted[i] ^ pad[i]
+	}
+	return id
+}
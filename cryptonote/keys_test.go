@@ -0,0 +1,86 @@
+package cryptonote
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The fixtures in testdata were computed with an independent
+// implementation of ed25519 and keccak, see testdata/README.
+func loadFixture(t *testing.T, name string, v interface{}) {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+}
+
+func parseKey(t *testing.T, s string) Key {
+	t.Helper()
+	k, err := ParseKey(s)
+	if err != nil {
+		t.Fatalf("%s: %v", s, err)
+	}
+	return k
+}
+
+func TestKeyDerivation(t *testing.T) {
+	var cases []struct {
+		ViewSecret  string `json:"view_secret"`
+		TxPublic    string `json:"tx_public"`
+		SpendPublic string `json:"spend_public"`
+		Derivation  string `json:"derivation"`
+		Outputs     []struct {
+			Index        uint64 `json:"index"`
+			SharedSecret string `json:"shared_secret"`
+			OutputKey    string `json:"output_key"`
+			ViewTag      byte   `json:"view_tag"`
+		} `json:"outputs"`
+	}
+	loadFixture(t, "derivation.json", &cases)
+
+	for _, c := range cases {
+		viewSecret, err := ParseSecretKey(c.ViewSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := GenerateKeyDerivation(parseKey(t, c.TxPublic), viewSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.String() != c.Derivation {
+			t.Errorf("derivation of %s: got %s, want %s", c.TxPublic, d, c.Derivation)
+			continue
+		}
+		spendPub := parseKey(t, c.SpendPublic)
+		for _, o := range c.Outputs {
+			if s := DerivationToScalar(d, o.Index); hex.EncodeToString(s.Bytes()) != o.SharedSecret {
+				t.Errorf("shared secret %d: got %x, want %s", o.Index, s.Bytes(), o.SharedSecret)
+			}
+			outKey, err := DerivePublicKey(d, o.Index, spendPub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if outKey.String() != o.OutputKey {
+				t.Errorf("output key %d: got %s, want %s", o.Index, outKey, o.OutputKey)
+			}
+			if tag := ViewTag(d, o.Index); tag != o.ViewTag {
+				t.Errorf("view tag %d: got %d, want %d", o.Index, tag, o.ViewTag)
+			}
+			// and back to the spend key the output was sent to
+			spend, err := DeriveSubaddressPublicKey(parseKey(t, o.OutputKey), d, o.Index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if spend != spendPub {
+				t.Errorf("spend key of output %d: got %s, want %s", o.Index, spend, spendPub)
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package cryptonote
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+
+	"filippo.io/edwards25519"
+)
+
+const (
+	RCTTypeNull = iota
+	RCTTypeFull
+	RCTTypeSimple
+	RCTTypeBulletproof
+	RCTTypeBulletproof2
+	RCTTypeCLSAG
+	RCTTypeBulletproofPlus
+)
+
+// H is the second generator used by pedersen commitments, C = xG + aH
+var H = func() *edwards25519.Point {
+	b, _ := hex.DecodeString("8b655970153799af2aeadc9ff1add0ea6c7251d54154cfa92c173a0dd39c1f94")
+	p, err := new(edwards25519.Point).SetBytes(b)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}()
+
+var ErrCommitmentMismatch = errors.New("Decoded amount does not match output commitment")
+
+// ECDHInfo is the encrypted amount (and for older transactions mask) of an output
+type ECDHInfo struct {
+	Mask   string `json:"mask"`
+	Amount string `json:"amount"`
+}
+
+// DecodeAmount recovers the amount of a RingCT output using the output's
+// shared secret Hs(D || index), and checks it against the commitment
+func DecodeAmount(rctType int, info ECDHInfo, commitment string, sharedSecret *edwards25519.Scalar) (uint64, error) {
+	var (
+		amount uint64
+		mask   *edwards25519.Scalar
+	)
+	switch rctType {
+	case RCTTypeFull, RCTTypeSimple, RCTTypeBulletproof:
+		encMask, err := parseScalar(info.Mask)
+		if err != nil {
+			return 0, err
+		}
+		encAmount, err := parseScalar(info.Amount)
+		if err != nil {
+			return 0, err
+		}
+		s1 := HashToScalar(sharedSecret.Bytes())
+		s2 := HashToScalar(s1.Bytes())
+		mask = edwards25519.NewScalar().Subtract(encMask, s1)
+		a := edwards25519.NewScalar().Subtract(encAmount, s2)
+		amount = binary.LittleEndian.Uint64(a.Bytes()[:8])
+	case RCTTypeBulletproof2, RCTTypeCLSAG, RCTTypeBulletproofPlus:
+		enc, err := hex.DecodeString(info.Amount)
+		if err != nil {
+			return 0, err
+		}
+		if len(enc) != 8 {
+			return 0, errors.New("Encrypted amount must be 8 bytes")
+		}
+		pad := Keccak256([]byte("amount"), sharedSecret.Bytes())
+		for i := range enc {
+			enc[i] ^= pad[i]
+		}
+		amount = binary.LittleEndian.Uint64(enc)
+		mask = HashToScalar([]byte("commitment_mask"), sharedSecret.Bytes())
+	default:
+		return 0, errors.New("Unsupported RingCT type")
+	}
+
+	c, err := ParseKey(commitment)
+	if err != nil {
+		return 0, err
+	}
+	C, err := ParsePublicKey(c)
+	if err != nil {
+		return 0, err
+	}
+	var a [32]byte
+	binary.LittleEndian.PutUint64(a[:], amount)
+	as, err := edwards25519.NewScalar().SetCanonicalBytes(a[:])
+	if err != nil {
+		return 0, err
+	}
+	expected := new(edwards25519.Point).ScalarBaseMult(mask)
+	expected.Add(expected, edwards25519.NewIdentityPoint().ScalarMult(as, H))
+	if expected.Equal(C) != 1 {
+		return 0, ErrCommitmentMismatch
+	}
+	return amount, nil
+}
+
+// parseScalar reduces rather than rejects, older encrypted amounts are not
+// always canonical
+func parseScalar(s string) (*edwards25519.Scalar, error) {
+	k, err := ParseKey(s)
+	if err != nil {
+		return nil, err
+	}
+	var wide [64]byte
+	copy(wide[:], k[:])
+	return edwards25519.NewScalar().SetUniformBytes(wide[:]), nil
+}
@@ -0,0 +1,44 @@
+package cryptonote
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"filippo.io/edwards25519"
+)
+
+func TestDecodeAmount(t *testing.T) {
+	var cases []struct {
+		Type         int      `json:"type"`
+		SharedSecret string   `json:"shared_secret"`
+		ECDHInfo     ECDHInfo `json:"ecdh_info"`
+		Commitment   string   `json:"commitment"`
+		Amount       uint64   `json:"amount"`
+	}
+	loadFixture(t, "ringct.json", &cases)
+
+	for _, c := range cases {
+		b, err := hex.DecodeString(c.SharedSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secret, err := edwards25519.NewScalar().SetCanonicalBytes(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		amount, err := DecodeAmount(c.Type, c.ECDHInfo, c.Commitment, secret)
+		if err != nil {
+			t.Errorf("type %d: %v", c.Type, err)
+			continue
+		}
+		if amount != c.Amount {
+			t.Errorf("type %d: got %d, want %d", c.Type, amount, c.Amount)
+		}
+
+		// the secret of another output doesn't open the commitment
+		other := HashToScalar(secret.Bytes())
+		if _, err := DecodeAmount(c.Type, c.ECDHInfo, c.Commitment, other); err != ErrCommitmentMismatch {
+			t.Errorf("type %d with the wrong secret: got %v, want %v", c.Type, err, ErrCommitmentMismatch)
+		}
+	}
+}
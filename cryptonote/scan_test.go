@@ -0,0 +1,202 @@
+package cryptonote
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// chainFixture is a wallet along with blocks as the daemon returns them,
+// get_block and the get_transactions entries of their transactions, and
+// the outputs each transaction pays the wallet
+type chainFixture struct {
+	Wallet struct {
+		Address    string `json:"address"`
+		ViewSecret string `json:"view_secret"`
+		Addresses  []struct {
+			Address string `json:"address"`
+			ID      int    `json:"id"`
+		} `json:"addresses"`
+	} `json:"wallet"`
+	Blocks []struct {
+		GetBlock json.RawMessage `json:"get_block"`
+		Txs      []struct {
+			TxHash string `json:"tx_hash"`
+			AsJSON string `json:"as_json"`
+		} `json:"txs"`
+	} `json:"blocks"`
+	Expected []struct {
+		TxHash  string `json:"tx_hash"`
+		Note    string `json:"note"`
+		Outputs []struct {
+			Index  uint64 `json:"index"`
+			Amount uint64 `json:"amount"`
+			ID     int    `json:"id"`
+		} `json:"outputs"`
+	} `json:"expected"`
+}
+
+// ServeHTTP answers get_block and get_transactions like monerod
+func (f *chainFixture) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/json_rpc":
+		var req struct {
+			Method string `json:"method"`
+			Params struct {
+				Height uint64 `json:"height"`
+			} `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Method != "get_block" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		for _, b := range f.Blocks {
+			var header struct {
+				BlockHeader struct {
+					Height uint64 `json:"height"`
+				} `json:"block_header"`
+			}
+			json.Unmarshal(b.GetBlock, &header)
+			if header.BlockHeader.Height == req.Params.Height {
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"jsonrpc": "2.0", "id": "0", "result": b.GetBlock,
+				})
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"jsonrpc": "2.0", "id": "0",
+			"error": map[string]interface{}{"code": -2, "message": "height too big"},
+		})
+	case "/get_transactions":
+		var req struct {
+			TxsHashes []string `json:"txs_hashes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		var txs []interface{}
+		missed := []string{}
+		for _, h := range req.TxsHashes {
+			found := false
+			for _, b := range f.Blocks {
+				for _, t := range b.Txs {
+					if t.TxHash == h {
+						txs = append(txs, t)
+						found = true
+					}
+				}
+			}
+			if !found {
+				missed = append(missed, h)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"txs": txs, "missed_tx": missed, "status": "OK",
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// TestScanChain fetches the blocks of every fixture in testdata/chain from
+// a stub daemon and scans all of their transactions for the wallet
+func TestScanChain(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "chain", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("No chain fixtures")
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			var f chainFixture
+			loadFixture(t, filepath.Join("chain", filepath.Base(file)), &f)
+			testScanChain(t, &f)
+		})
+	}
+}
+
+func testScanChain(t *testing.T, f *chainFixture) {
+	addr, err := DecodeAddress(f.Wallet.Address, Monero.Networks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := ParseSecretKey(f.Wallet.ViewSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !addr.MatchesViewKey(secret) {
+		t.Fatal("The view key doesn't belong to the wallet")
+	}
+	account := &Account{ViewSecret: secret, SpendPub: addr.SpendPub}
+	for _, a := range f.Wallet.Addresses {
+		decoded, err := DecodeAddress(a.Address, Monero.Networks)
+		if err != nil {
+			t.Fatalf("%s: %v", a.Address, err)
+		}
+		if err := account.AddAddress(decoded, a.ID); err != nil {
+			t.Fatalf("%s: %v", a.Address, err)
+		}
+	}
+
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	daemon, err := NewDaemon(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scanned := make(map[string][]*Output)
+	for _, b := range f.Blocks {
+		var header struct {
+			BlockHeader struct {
+				Height uint64 `json:"height"`
+			} `json:"block_header"`
+		}
+		if err := json.Unmarshal(b.GetBlock, &header); err != nil {
+			t.Fatal(err)
+		}
+		block, err := daemon.Block(context.Background(), header.BlockHeader.Height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(block.Transactions) != len(b.Txs)+1 {
+			t.Fatalf("block %d: got %d transactions, want %d with the miner transaction",
+				block.Height, len(block.Transactions), len(b.Txs)+1)
+		}
+		for _, tx := range block.Transactions {
+			outputs, err := account.Scan(tx)
+			if err != nil {
+				t.Fatalf("tx %s: %v", tx.Hash, err)
+			}
+			scanned[tx.Hash] = outputs
+		}
+	}
+
+	for _, want := range f.Expected {
+		got, ok := scanned[want.TxHash]
+		if !ok {
+			t.Errorf("%s: tx %s wasn't in any block", want.Note, want.TxHash)
+			continue
+		}
+		if len(got) != len(want.Outputs) {
+			t.Errorf("%s: got %d outputs, want %d", want.Note, len(got), len(want.Outputs))
+			continue
+		}
+		for i, o := range want.Outputs {
+			if got[i].Index != o.Index || got[i].Amount != o.Amount || got[i].ID != o.ID {
+				t.Errorf("%s: output %d is index %d, %d for %d, want index %d, %d for %d",
+					want.Note, i, got[i].Index, got[i].Amount, got[i].ID, o.Index, o.Amount, o.ID)
+			}
+		}
+	}
+	if len(scanned) != len(f.Expected) {
+		t.Errorf("Scanned %d transactions, %d are expected", len(scanned), len(f.Expected))
+	}
+}
@@ -0,0 +1,272 @@
+package cryptonote
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+
+	"filippo.io/edwards25519"
+)
+
+const (
+	extraPadding        = 0x00
+	extraPubKey         = 0x01
+	extraNonce          = 0x02
+	extraMergeMining    = 0x03
+	extraAdditionalKeys = 0x04
+	extraMinergate      = 0xde
+)
+
+// Transaction is the subset of a daemon's decode_as_json output needed for scanning
+type Transaction struct {
+	Hash       string `json:"-"`
+	Version    int    `json:"version"`
+	UnlockTime uint64 `json:"unlock_time"`
+	Vin        []struct {
+		Gen *struct {
+			Height uint64 `json:"height"`
+		} `json:"gen"`
+	} `json:"vin"`
+	Vout []struct {
+		Amount uint64 `json:"amount"`
+		Target struct {
+			Key       string `json:"key"`
+			TaggedKey *struct {
+				Key     string `json:"key"`
+				ViewTag string `json:"view_tag"`
+			} `json:"tagged_key"`
+		} `json:"target"`
+	} `json:"vout"`
+	Extra         byteArray `json:"extra"`
+	RctSignatures struct {
+		Type     int        `json:"type"`
+		ECDHInfo []ECDHInfo `json:"ecdhInfo"`
+		OutPk    []string   `json:"outPk"`
+	} `json:"rct_signatures"`
+}
+
+func (t *Transaction) Coinbase() bool {
+	return len(t.Vin) == 1 && t.Vin[0].Gen != nil
+}
+
+// Extra holds the public keys found in a transaction's extra field
+type Extra struct {
+	TxPubKey       *Key
+	AdditionalKeys []Key
+	Nonce          []byte
+}
+
+func ParseExtra(extra []byte) (*Extra, error) {
+	e := &Extra{}
+	for i := 0; i < len(extra); {
+		tag := extra[i]
+		i++
+		switch tag {
+		case extraPadding:
+			// padding runs to the end of extra
+			return e, nil
+		case extraPubKey:
+			if i+32 > len(extra) {
+				return e, errors.New("Truncated tx public key in extra")
+			}
+			// only the first tx public key counts
+			if e.TxPubKey == nil {
+				var k Key
+				copy(k[:], extra[i:i+32])
+				e.TxPubKey = &k
+			}
+			i += 32
+		case extraAdditionalKeys:
+			n, l := binary.Uvarint(extra[i:])
+			// n*32 could overflow, the keys left are counted instead
+			if l <= 0 || n > uint64(len(extra)-i-l)/32 {
+				return e, errors.New("Truncated additional public keys in extra")
+			}
+			i += l
+			for j := uint64(0); j < n; j++ {
+				var k Key
+				copy(k[:], extra[i:i+32])
+				e.AdditionalKeys = append(e.AdditionalKeys, k)
+				i += 32
+			}
+		case extraNonce, extraMergeMining, extraMinergate:
+			n, l := binary.Uvarint(extra[i:])
+			if l <= 0 || uint64(len(extra)-i-l) < n {
+				return e, errors.New("Truncated field in extra")
+			}
+			i += l
+			if tag == extraNonce {
+				e.Nonce = extra[i : i+int(n)]
+			}
+			i += int(n)
+		default:
+			return e, errors.New("Unknown tag in extra")
+		}
+	}
+	return e, nil
+}
+
+// EncryptedPaymentID returns the short payment ID from the extra nonce
+func (e *Extra) EncryptedPaymentID() []byte {
+	if len(e.Nonce) == 1+paymentIDSize && e.Nonce[0] == 0x01 {
+		return e.Nonce[1:]
+	}
+	return nil
+}
+
+// Account is the view-only half of a wallet, enough to detect incoming outputs
+type Account struct {
+	ViewSecret *edwards25519.Scalar
+	SpendPub   Key
+	// Subaddresses and PaymentIDs map the subaddress spend keys and the
+	// hex payment IDs of integrated addresses of the wallet to an ID of the
+	// caller's choosing, which is reported back in Output.ID
+	Subaddresses map[Key]int
+	PaymentIDs   map[string]int
+}
+
+// Output is an output of a transaction that belongs to an account
+type Output struct {
+	Index  uint64
+	Key    Key
+	Amount uint64
+	// ID is the ID of the subaddress or integrated address the output was
+	// sent to, or 0 for the main address
+	ID int
+}
+
+// AddAddress has the account look for payments to a subaddress or
+// integrated address of its wallet, and report them with id
+func (a *Account) AddAddress(addr *Address, id int) error {
+	switch addr.Kind {
+	case Subaddress:
+		if !addr.MatchesViewKey(a.ViewSecret) {
+			return errors.New("Subaddress does not belong to the wallet")
+		}
+		if a.Subaddresses == nil {
+			a.Subaddresses = make(map[Key]int)
+		}
+		a.Subaddresses[addr.SpendPub] = id
+	case IntegratedAddress:
+		if addr.SpendPub != a.SpendPub || !addr.MatchesViewKey(a.ViewSecret) {
+			return errors.New("Integrated address does not belong to the wallet")
+		}
+		if a.PaymentIDs == nil {
+			a.PaymentIDs = make(map[string]int)
+		}
+		a.PaymentIDs[hex.EncodeToString(addr.PaymentID)] = id
+	default:
+		return errors.New("Expected a subaddress or an integrated address")
+	}
+	return nil
+}
+
+// Scan returns the outputs of t which were sent to the account
+func (a *Account) Scan(t *Transaction) ([]*Output, error) {
+	extra, err := ParseExtra(t.Extra)
+	if err != nil && extra.TxPubKey == nil {
+		return nil, err
+	}
+	var derivations []Key
+	if extra.TxPubKey != nil {
+		d, err := GenerateKeyDerivation(*extra.TxPubKey, a.ViewSecret)
+		if err == nil {
+			derivations = append(derivations, d)
+		}
+	}
+	var additional []*Key
+	for i := range extra.AdditionalKeys {
+		d, err := GenerateKeyDerivation(extra.AdditionalKeys[i], a.ViewSecret)
+		if err != nil {
+			additional = append(additional, nil)
+			continue
+		}
+		additional = append(additional, &d)
+	}
+
+	var outputs []*Output
+	for i, out := range t.Vout {
+		index := uint64(i)
+		key, tag := out.Target.Key, ""
+		if out.Target.TaggedKey != nil {
+			key, tag = out.Target.TaggedKey.Key, out.Target.TaggedKey.ViewTag
+		}
+		outKey, err := ParseKey(key)
+		if err != nil {
+			return nil, err
+		}
+
+		candidates := derivations
+		if i < len(additional) && additional[i] != nil {
+			candidates = append(candidates[:len(candidates):len(candidates)], *additional[i])
+		}
+		for _, d := range candidates {
+			if tag != "" && hexByte(ViewTag(d, index)) != tag {
+				continue
+			}
+			spendPub, err := DeriveSubaddressPublicKey(outKey, d, index)
+			if err != nil {
+				return nil, err
+			}
+			id := 0
+			if spendPub == a.SpendPub {
+				if pid := extra.EncryptedPaymentID(); pid != nil && len(derivations) > 0 {
+					id = a.PaymentIDs[hex.EncodeToString(DecryptPaymentID(pid, derivations[0]))]
+				}
+			} else if sub, ok := a.Subaddresses[spendPub]; ok {
+				id = sub
+			} else {
+				continue
+			}
+
+			amount := out.Amount
+			if t.RctSignatures.Type != RCTTypeNull {
+				if i >= len(t.RctSignatures.ECDHInfo) || i >= len(t.RctSignatures.OutPk) {
+					return nil, errors.New("Missing RingCT data for output")
+				}
+				amount, err = DecodeAmount(t.RctSignatures.Type,
+					t.RctSignatures.ECDHInfo[i], t.RctSignatures.OutPk[i],
+					DerivationToScalar(d, index))
+				if err == ErrCommitmentMismatch {
+					// the sender lied about the amount, the output can't be spent as claimed
+					break
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+			outputs = append(outputs, &Output{
+				Index:  index,
+				Key:    outKey,
+				Amount: amount,
+				ID:     id,
+			})
+			break
+		}
+	}
+	return outputs, nil
+}
+
+// byteArray decodes the JSON number arrays monerod uses for binary fields
+type byteArray []byte
+
+func (b *byteArray) UnmarshalJSON(data []byte) error {
+	var ints []int
+	if err := json.Unmarshal(data, &ints); err != nil {
+		return err
+	}
+	*b = make([]byte, len(ints))
+	for i, v := range ints {
+		if v < 0 || v > 0xff {
+			return errors.New("Byte out of range")
+		}
+		(*b)[i] = byte(v)
+	}
+	return nil
+}
+
+func hexByte(b byte) string {
+	const digits = "0123456789abcdef"
+	return string([]byte{digits[b>>4], digits[b&0x0f]})
+}
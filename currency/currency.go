@@ -0,0 +1,119 @@
+package currency
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Currency describes how the atomic units stored in payments.amount are
+// displayed. Amounts are only ever converted for display, never stored
+// in display units.
+type Currency struct {
+	PayType  string
+	Ticker   string
+	Symbol   string
+	Decimals int
+}
+
+var (
+	Monero = &Currency{
+		PayType:  "application/monero-paymentrequest",
+		Ticker:   "XMR",
+		Symbol:   "ɱ",
+		Decimals: 12,
+	}
+	Wownero = &Currency{
+		PayType:  "application/wownero-paymentrequest",
+		Ticker:   "WOW",
+		Symbol:   "WOW",
+		Decimals: 11,
+	}
+	Bitcoin = &Currency{
+		PayType:  "application/bitcoin-paymentrequest",
+		Ticker:   "BTC",
+		Symbol:   "₿",
+		Decimals: 8,
+	}
+	// Lightning votes are bitcoin as well, recorded in satoshi
+	Lightning = &Currency{
+		PayType:  "application/lightning-paymentrequest",
+		Ticker:   "BTC",
+		Symbol:   "⚡",
+		Decimals: 8,
+	}
+
+	Currencies = []*Currency{Monero, Wownero, Bitcoin, Lightning}
+)
+
+func ForPayType(payType string) *Currency {
+	for _, c := range Currencies {
+		if c.PayType == payType {
+			return c
+		}
+	}
+	return nil
+}
+
+// ForURI finds the currency of a payment URI by its scheme, e.g. monero:
+func ForURI(uri string) *Currency {
+	i := strings.Index(uri, ":")
+	if i < 0 {
+		return nil
+	}
+	return ForPayType("application/" + strings.ToLower(uri[:i]) + "-paymentrequest")
+}
+
+// Format renders an amount of atomic units as an exact decimal, without
+// trailing zeros
+func (c *Currency) Format(atomic *big.Int) string {
+	sign := ""
+	if atomic.Sign() < 0 {
+		sign = "-"
+		atomic = new(big.Int).Neg(atomic)
+	}
+	digits := atomic.String()
+	if len(digits) <= c.Decimals {
+		digits = strings.Repeat("0", c.Decimals-len(digits)+1) + digits
+	}
+	whole, frac := digits[:len(digits)-c.Decimals], digits[len(digits)-c.Decimals:]
+	frac = strings.TrimRight(frac, "0")
+	if frac == "" {
+		return sign + whole
+	}
+	return sign + whole + "." + frac
+}
+
+// FormatString formats atomic units as returned by postgres for a numeric
+func (c *Currency) FormatString(atomic string) string {
+	n, ok := new(big.Int).SetString(atomic, 10)
+	if !ok {
+		return atomic
+	}
+	return c.Format(n)
+}
+
+func (c *Currency) FormatUint(atomic uint64) string {
+	return c.Format(new(big.Int).SetUint64(atomic))
+}
+
+// Parse converts a decimal amount in display units to atomic units,
+// rejecting anything more precise than the currency allows
+func (c *Currency) Parse(amount string) (uint64, error) {
+	whole, frac := amount, ""
+	if i := strings.IndexByte(amount, '.'); i >= 0 {
+		whole, frac = amount[:i], amount[i+1:]
+	}
+	if len(frac) > c.Decimals {
+		return 0, fmt.Errorf("%s has at most %d decimals", c.Ticker, c.Decimals)
+	}
+	if whole == "" {
+		whole = "0"
+	}
+	n, err := strconv.ParseUint(whole+frac+strings.Repeat("0", c.Decimals-len(frac)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s amount %q", c.Ticker, amount)
+	}
+	return n, nil
+}
@@ -0,0 +1,90 @@
+package feeds
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// MatchAuthors finds the authors a feed's author already is, among those
+// listing one of its payment addresses. Addresses are public, so sharing one
+// proves nothing by itself, and neither does a listing someone else made
+// first: an author only matches once the user verified a claim to one of its
+// feeds, or for the addresses in opened, which a view key in the feed was
+// checked to open, if the author's own view key for it was checked as well.
+// Authors matched by a claim come first. Emails and URIs are never matched,
+// anyone can write them into a feed.
+func MatchAuthors(ctx context.Context, tx pgx.Tx, userID int,
+	addresses, opened []string) ([]int, error) {
+	var ids []int
+	rows, err := tx.Query(ctx, `
+		SELECT author_id FROM (
+			SELECT ap.author_id,
+				EXISTS (
+					SELECT 1 FROM feed_claims c
+					INNER JOIN feeds f ON c.feed_id = f.id
+					WHERE f.author_id = ap.author_id AND c.user_id = $3
+						AND c.verified IS NOT NULL
+				) AS claimed,
+				ap.address = ANY($2) AND ap.view_key_checked AS opened
+			FROM accepted_payments ap
+			WHERE ap.address = ANY($1)
+		) m
+		WHERE claimed OR opened
+		GROUP BY author_id
+		ORDER BY bool_or(claimed) DESC, author_id;
+	`, addresses, opened, userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	return ids, rows.Err()
+}
+
+// MergeAuthors moves the feeds and accepted payments of authors from over to
+// the author into, with them their votes, and removes the duplicates. Details
+// the kept author lacks are taken from the duplicates.
+func MergeAuthors(ctx context.Context, tx pgx.Tx, into int, from []int) error {
+	if len(from) == 0 {
+		return nil
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE authors a SET
+			name = COALESCE(NULLIF(a.name, ''), d.name),
+			url = COALESCE(NULLIF(a.url, ''), d.url),
+			email = COALESCE(NULLIF(a.email, ''), d.email),
+			updated = NOW() at time zone 'utc'
+		FROM (
+			SELECT
+				(array_agg(name ORDER BY id) FILTER (WHERE name <> ''))[1] AS name,
+				(array_agg(url ORDER BY id) FILTER (WHERE url <> ''))[1] AS url,
+				(array_agg(email ORDER BY id) FILTER (WHERE email <> ''))[1] AS email
+			FROM authors WHERE id = ANY($2)
+		) d
+		WHERE a.id = $1;
+	`, into, from); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE feeds SET author_id = $1 WHERE author_id = ANY($2);
+	`, into, from); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE accepted_payments SET author_id = $1 WHERE author_id = ANY($2);
+	`, into, from); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, `
+		DELETE FROM authors WHERE id = ANY($1) AND id <> $2;
+	`, from, into)
+	return err
+}
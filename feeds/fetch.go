@@ -1,6 +1,7 @@
 package feeds
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -11,6 +12,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/t-900-a/gemmit/cryptonote"
+	"github.com/t-900-a/gemmit/currency"
+
 	"git.sr.ht/~adnano/go-gemini"
 	"github.com/jackc/pgx/v4"
 	"github.com/t-900-a/rss"
@@ -21,7 +25,7 @@ const (
 	FEED_GEMINI = "gemini"
 )
 
-func fetchGemini(ctx context.Context, remoteURL *url.URL) (*rss.Feed, string, error) {
+func getGemini(ctx context.Context, remoteURL *url.URL) ([]byte, string, error) {
 	client := &gemini.Client{}
 	tctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
@@ -41,12 +45,27 @@ func fetchGemini(ctx context.Context, remoteURL *url.URL) (*rss.Feed, string, er
 	}
 
 	reader := io.LimitReader(resp.Body, 1073741824) // 1 GiB
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, mimetype, nil
+}
+
+func fetchGemini(ctx context.Context, remoteURL *url.URL) (*rss.Feed, string, error) {
+	data, mimetype, err := getGemini(ctx, remoteURL)
+	if err != nil {
+		return nil, "", err
+	}
 
 	switch mimetype {
 	case "text/gemini":
-		var feed rss.Feed
+		var (
+			feed     rss.Feed
+			payments []*rss.Link
+		)
 		feed.Link = remoteURL.String()
-		text, err := gemini.ParseText(resp.Body)
+		text, err := gemini.ParseText(bytes.NewReader(data))
 		if err != nil {
 			return nil, "", err
 		}
@@ -57,6 +76,10 @@ func fetchGemini(ctx context.Context, remoteURL *url.URL) (*rss.Feed, string, er
 					feed.Title = strings.TrimLeft(line.String(), "# ")
 				}
 			case gemini.LineLink:
+				if c := currency.ForURI(line.URL); c != nil {
+					payments = appendPayment(payments, c, line.URL)
+					continue
+				}
 				if line.Name == "" || len(line.Name) < 10 {
 					continue
 				}
@@ -77,52 +100,110 @@ func fetchGemini(ctx context.Context, remoteURL *url.URL) (*rss.Feed, string, er
 				feed.Items = append(feed.Items, item)
 			}
 		}
+		// gemfeeds have no author element, the feed's directory stands in
+		// for it, capsules often host several authors under ~user/
+		feed.Author = &rss.Author{
+			Name: remoteURL.Hostname(),
+			URI:  feedDirectory(remoteURL).String(),
+		}
+		feed.Author.Extensions = payments
 		return &feed, FEED_GEMINI, nil
 	case "text/xml",
 		"application/rss+xml",
 		"application/atom+xml",
 		"application/xml":
-		data, err := io.ReadAll(reader)
-		if err != nil {
-			return nil, "", err
-		}
 		feed, err := rss.Parse(data)
 
 		return feed, FEED_RSS, err
 	default:
-		return nil, "", fmt.Errorf("Cannot interpret %s as a feed", resp.Meta)
+		return nil, "", fmt.Errorf("Cannot interpret %s as a feed", mimetype)
 	}
-	panic("unreachable")
 }
 
-func fetchHTTP(ctx context.Context, url *url.URL) (*rss.Feed, string, error) {
+// appendPayment adds a payment link unless it's already there
+func appendPayment(payments []*rss.Link, c *currency.Currency, uri string) []*rss.Link {
+	for _, link := range payments {
+		if link.Href == uri {
+			return payments
+		}
+	}
+	return append(payments, &rss.Link{Rel: "payment", Type: c.PayType, Href: uri})
+}
+
+// feedDirectory is the directory a feed is in
+func feedDirectory(remoteURL *url.URL) *url.URL {
+	return remoteURL.ResolveReference(&url.URL{Path: "./"})
+}
+
+// fetchManifest reads the gemmit manifest of a feed, .well-known/gemmit in
+// the feed's directory or else /.well-known/gemmit of the capsule. It is
+// gemtext, a heading names the author and payment links like
+// => monero:<address> apply to all of the feeds next to it.
+func fetchManifest(ctx context.Context, remoteURL *url.URL) (*rss.Author, error) {
+	manifestURL := feedDirectory(remoteURL).ResolveReference(&url.URL{Path: ".well-known/gemmit"})
+	rootURL := remoteURL.ResolveReference(&url.URL{Path: "/.well-known/gemmit"})
+	data, mimetype, err := getGemini(ctx, manifestURL)
+	if err != nil && manifestURL.String() != rootURL.String() {
+		data, mimetype, err = getGemini(ctx, rootURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if mimetype != "text/gemini" && mimetype != "text/plain" {
+		return nil, fmt.Errorf("Cannot interpret %s as a gemmit manifest", mimetype)
+	}
+	text, err := gemini.ParseText(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	author := &rss.Author{}
+	for _, line := range text {
+		switch line := line.(type) {
+		case gemini.LineHeading1:
+			if author.Name == "" {
+				author.Name = strings.TrimLeft(line.String(), "# ")
+			}
+		case gemini.LineLink:
+			if c := currency.ForURI(line.URL); c != nil {
+				author.Extensions = appendPayment(author.Extensions, c, line.URL)
+			}
+		}
+	}
+	return author, nil
+}
+
+func getHTTP(ctx context.Context, url *url.URL) ([]byte, error) {
 	client := &http.Client{
 		Timeout: 10 * time.Second,
 	}
 
 	req, err := http.NewRequestWithContext(ctx, "GET", url.String(), nil)
-	req.Header.Add("User-Agent", "gemmit (https://github.com/t-900-a/gemmit)")
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
+	req.Header.Add("User-Agent", "gemmit (https://github.com/t-900-a/gemmit)")
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return nil, "", fmt.Errorf("Unexpected HTTP response %s", resp.Status)
+		return nil, fmt.Errorf("Unexpected HTTP response %s", resp.Status)
 	}
 
 	if resp.Header.Get("Content-Type") == "text/html" {
 		// TODO
-		return nil, "", fmt.Errorf("Extracting feed from HTML pages is unimplemented")
+		return nil, fmt.Errorf("Extracting feed from HTML pages is unimplemented")
 	}
 
 	reader := io.LimitReader(resp.Body, 1073741824) // 1 GiB
-	data, err := io.ReadAll(reader)
+	return io.ReadAll(reader)
+}
+
+func fetchHTTP(ctx context.Context, url *url.URL) (*rss.Feed, string, error) {
+	data, err := getHTTP(ctx, url)
 	if err != nil {
 		return nil, "", err
 	}
@@ -141,6 +222,41 @@ func Fetch(ctx context.Context, url *url.URL) (*rss.Feed, string, error) {
 	}
 }
 
+// FetchWithManifest fetches a feed like Fetch, gemfeeds are completed with
+// the author's name and payment links from their gemmit manifest. Only
+// adding or previewing a feed needs those, refreshing entries doesn't.
+func FetchWithManifest(ctx context.Context, url *url.URL) (*rss.Feed, string, error) {
+	feed, kind, err := Fetch(ctx, url)
+	if err != nil || kind != FEED_GEMINI {
+		return feed, kind, err
+	}
+	manifest, err := fetchManifest(ctx, url)
+	if err != nil {
+		return feed, kind, nil
+	}
+	if manifest.Name != "" {
+		feed.Author.Name = manifest.Name
+	}
+	for _, link := range manifest.Extensions {
+		feed.Author.Extensions = appendPayment(feed.Author.Extensions,
+			currency.ForPayType(link.Type), link.Href)
+	}
+	return feed, kind, nil
+}
+
+// Get fetches a feed without parsing it
+func Get(ctx context.Context, url *url.URL) ([]byte, error) {
+	switch url.Scheme {
+	case "gemini":
+		data, _, err := getGemini(ctx, url)
+		return data, err
+	case "https":
+		return getHTTP(ctx, url)
+	default:
+		return nil, fmt.Errorf("Unsupported protocol '%s'", url.Scheme)
+	}
+}
+
 func Index(ctx context.Context, tx pgx.Tx,
 	items []*rss.Item, feedId int) error {
 	_, err := tx.Exec(ctx,
@@ -148,8 +264,10 @@ func Index(ctx context.Context, tx pgx.Tx,
 			title varchar,
 			published timestamp,
 			url varchar,
-			feed_id INTEGER
-		);`)
+			feed_id INTEGER,
+			pay_address varchar
+		);
+		TRUNCATE entries_temp;`)
 	if err != nil {
 		return err
 	}
@@ -157,13 +275,13 @@ func Index(ctx context.Context, tx pgx.Tx,
 	rows := make([][]interface{}, len(items))
 	for i, item := range items {
 		rows[i] = []interface{}{
-			item.Title, item.Date, item.Link, feedId,
+			item.Title, item.Date, item.Link, feedId, entryPaymentAddress(item),
 		}
 	}
 
 	_, err = tx.CopyFrom(ctx,
 		pgx.Identifier{"entries_temp"},
-		[]string{"title", "published", "url", "feed_id"},
+		[]string{"title", "published", "url", "feed_id", "pay_address"},
 		pgx.CopyFromRows(rows),
 	)
 	if err != nil {
@@ -172,10 +290,11 @@ func Index(ctx context.Context, tx pgx.Tx,
 
 	result, err := tx.Exec(ctx, `
 		INSERT INTO entries
-		(title, published, url, feed_id)
-		SELECT title, published, url, feed_id
+		(title, published, url, feed_id, pay_address)
+		SELECT DISTINCT ON (url, feed_id) title, published, url, feed_id, pay_address
 		FROM entries_temp
-		ON CONFLICT DO NOTHING;
+		ON CONFLICT ON CONSTRAINT entries_url_feed_id_key
+		DO UPDATE SET pay_address = EXCLUDED.pay_address;
 	`)
 	if err != nil {
 		return err
@@ -192,3 +311,32 @@ func Index(ctx context.Context, tx pgx.Tx,
 	log.Printf("Imported %d items for feed %d", ra, feedId)
 	return nil
 }
+
+// entryPaymentAddress finds the address an author published for votes on a
+// single entry, as a payment link within the atom entry. Gemmit maps
+// payments to it back onto the entry. Addresses that don't decode on the
+// coin's main network are skipped like /add would reject them.
+func entryPaymentAddress(item *rss.Item) *string {
+	for _, enc := range item.Enclosures {
+		coin := cryptonote.CoinForPayType(enc.Type)
+		if coin == nil {
+			continue
+		}
+		address := enc.URL[strings.Index(enc.URL, ":")+1:]
+		if i := strings.Index(address, "?"); i >= 0 {
+			address = address[:i]
+		}
+		addr, err := coin.DecodeAddress(address)
+		if err != nil {
+			log.Printf("Skipping %s address of entry %s: %v", coin.Name, item.Link, err)
+			continue
+		}
+		if addr.Network != coin.Network {
+			log.Printf("Skipping %s address of entry %s: %s address on %s",
+				coin.Name, item.Link, addr.Kind, addr.Network.Name)
+			continue
+		}
+		return &address
+	}
+	return nil
+}
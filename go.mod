@@ -3,10 +3,14 @@ module github.com/t-900-a/gemmit
 go 1.16
 
 require (
+	filippo.io/edwards25519 v1.0.0-beta.2
 	git.sr.ht/~adnano/go-gemini v0.1.20-0.20210305163501-107b3a178579
+	github.com/btcsuite/btcd v0.20.1-beta
+	github.com/btcsuite/btcutil v1.0.2
 	github.com/jackc/pgx/v4 v4.10.1
 	github.com/lib/pq v1.9.0 // indirect
-	github.com/t-900-a/rss v1.2.2-0.20210314165843-b33fce8b6b1c // indirect
+	github.com/t-900-a/rss v1.2.2-0.20210314165843-b33fce8b6b1c
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	//github.com/t-900-a/rss v1.2.6 // indirect
 	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110 // indirect
 	golang.org/x/text v0.3.5 // indirect
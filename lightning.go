@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/t-900-a/gemmit/currency"
+	"github.com/t-900-a/gemmit/feeds"
+	"github.com/t-900-a/gemmit/lightning"
+	"github.com/t-900-a/gemmit/votes"
+
+	"git.sr.ht/~adnano/go-gemini"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+)
+
+// lightningClient is a test client with the -lightning-test flag
+var lightningClient = lightning.NewClient("bc")
+
+// every invoice costs a request to the author's server, voters and feeds
+// only get so many an hour
+var (
+	feedInvoices   = newRateLimiter(60, time.Hour)
+	clientInvoices = newRateLimiter(10, time.Hour)
+)
+
+// withPgxTx runs fn in a transaction on a pgx connection, the votes
+// package works with pgx like the scanners do
+func withPgxTx(ctx context.Context, fn func(tx pgx.Tx) error) error {
+	conn, err := feeds.ForContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Raw(func(driverConn interface{}) error {
+		conn := driverConn.(*stdlib.Conn).Conn()
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	})
+}
+
+// lightningVote asks for an amount and hands out an invoice from the
+// author's LNURL-pay endpoint, /lightning/<feed id>
+func lightningVote(ctx context.Context, w gemini.ResponseWriter, r *gemini.Request) {
+	feedID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/lightning/"))
+	if err != nil {
+		w.WriteHeader(51, "Not found")
+		return
+	}
+
+	inv := &votes.Invoice{FeedID: feedID}
+	if err := feeds.WithTx(ctx, &sql.TxOptions{
+		ReadOnly: true,
+	}, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, `
+			SELECT ap.id, ap.address, COALESCE(f.title, '')
+			FROM feeds f
+			INNER JOIN accepted_payments ap ON ap.author_id = f.author_id
+			WHERE f.id = $1 AND f.approved = true AND NOT f.delisted
+				AND ap.pay_type = $2 AND ap.retired IS NULL
+			ORDER BY ap.id
+			LIMIT 1;
+		`, feedID, currency.Lightning.PayType)
+		return row.Scan(&inv.AcceptedPaymentID, &inv.Address, &inv.Feed)
+	}); err == sql.ErrNoRows {
+		w.WriteHeader(51, "This feed doesn't accept Lightning votes")
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(40, "Internal server error")
+		return
+	}
+
+	endpoint, err := lightning.Endpoint(inv.Address)
+	if err != nil {
+		w.WriteHeader(51, "This feed doesn't accept Lightning votes")
+		return
+	}
+	pr, err := lightningClient.PayRequest(ctx, endpoint)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(40, "The author's Lightning server is unavailable")
+		return
+	}
+
+	if r.URL.RawQuery == "" {
+		w.WriteHeader(10, fmt.Sprintf("Vote for %s, amount in sats (%d to %d)",
+			inv.Feed, (pr.MinSendable+999)/1000, pr.MaxSendable/1000))
+		return
+	}
+	query, err := url.QueryUnescape(r.URL.RawQuery)
+	if err != nil {
+		w.WriteHeader(10, err.Error()+": Try again")
+		return
+	}
+	sats, err := strconv.ParseUint(strings.TrimSpace(query), 10, 64)
+	if err != nil || sats == 0 {
+		w.WriteHeader(10, "Amount must be a whole number of sats: Try again")
+		return
+	}
+	now := time.Now()
+	client, _, err := net.SplitHostPort(r.Conn().RemoteAddr().String())
+	if err != nil {
+		client = r.Conn().RemoteAddr().String()
+	}
+	if wait := clientInvoices.allow(client, now); wait > 0 {
+		w.WriteHeader(44, strconv.Itoa(int(wait.Seconds())+1))
+		return
+	}
+	if wait := feedInvoices.allow(strconv.Itoa(feedID), now); wait > 0 {
+		w.WriteHeader(44, strconv.Itoa(int(wait.Seconds())+1))
+		return
+	}
+	resp, err := lightningClient.RequestInvoice(ctx, pr, sats*1000)
+	if err != nil {
+		w.WriteHeader(10, err.Error()+": Try again")
+		return
+	}
+
+	inv.PaymentHash = resp.Invoice.PaymentHash
+	inv.PR = resp.PR
+	inv.Amount = sats
+	inv.Verify = resp.Verify
+	inv.Created = time.Now().UTC()
+	inv.Expires = resp.Invoice.Expires()
+	if err := withPgxTx(ctx, func(tx pgx.Tx) error {
+		return votes.RecordInvoice(ctx, tx, inv)
+	}); err != nil {
+		log.Println(err)
+		w.WriteHeader(40, "Internal server error")
+		return
+	}
+
+	w.WriteHeader(30, "/lightning/invoice/"+inv.PaymentHash)
+}
+
+// lightningInvoice shows an invoice, checking with the author's server
+// whether it has been paid, /lightning/invoice/<payment hash>. Paid invoices
+// are unverified votes, see votes.SettleInvoice.
+func lightningInvoice(ctx context.Context, w gemini.ResponseWriter, r *gemini.Request) {
+	hash := strings.TrimPrefix(r.URL.Path, "/lightning/invoice/")
+	var inv *votes.Invoice
+	if err := withPgxTx(ctx, func(tx pgx.Tx) error {
+		var err error
+		inv, err = votes.LoadInvoice(ctx, tx, hash)
+		return err
+	}); err == pgx.ErrNoRows {
+		w.WriteHeader(51, "Not found")
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(40, "Internal server error")
+		return
+	}
+
+	// the author's server is asked outside of the transaction, it may be
+	// slow to answer
+	if inv.Settled == nil && inv.Verify != "" {
+		settled, err := lightningClient.Verify(ctx, inv.Verify, inv.PaymentHash)
+		if err != nil {
+			// the invoice is still shown, checking again is up to the voter
+			log.Printf("Failed to check invoice %d: %v", inv.ID, err)
+		} else if settled {
+			if err := withPgxTx(ctx, func(tx pgx.Tx) error {
+				// checklightning may have been quicker
+				current, err := votes.LoadInvoice(ctx, tx, hash)
+				if err != nil || current.Settled != nil {
+					inv = current
+					return err
+				}
+				if err := votes.SettleInvoice(ctx, tx, current, time.Now().UTC()); err != nil {
+					return err
+				}
+				inv = current
+				return nil
+			}); err != nil {
+				log.Println(err)
+				w.WriteHeader(40, "Internal server error")
+				return
+			}
+		}
+	}
+
+	w.WriteHeader(20, "text/gemini")
+	err := lightningInvoicePage.Execute(w, &LightningInvoicePage{
+		Invoice: inv,
+		Expired: inv.Settled == nil && time.Now().After(inv.Expires),
+		Logo:    gemmitLogo,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// lightningPreimage marks an invoice paid given its preimage, for authors
+// whose server doesn't report payments, /lightning/preimage/<payment hash>.
+// The author knows the preimage as well, so the vote stays unverified.
+func lightningPreimage(ctx context.Context, w gemini.ResponseWriter, r *gemini.Request) {
+	hash := strings.TrimPrefix(r.URL.Path, "/lightning/preimage/")
+	if r.URL.RawQuery == "" {
+		w.WriteHeader(10, "Enter the payment preimage (proof of payment) shown by your wallet")
+		return
+	}
+	preimage, err := url.QueryUnescape(r.URL.RawQuery)
+	if err != nil {
+		w.WriteHeader(10, err.Error()+": Try again")
+		return
+	}
+	if !lightning.CheckPreimage(hash, strings.TrimSpace(preimage)) {
+		w.WriteHeader(10, "Not the preimage of this invoice: Try again")
+		return
+	}
+
+	if err := withPgxTx(ctx, func(tx pgx.Tx) error {
+		inv, err := votes.LoadInvoice(ctx, tx, hash)
+		if err != nil || inv.Settled != nil {
+			return err
+		}
+		return votes.SettleInvoice(ctx, tx, inv, time.Now().UTC())
+	}); err == pgx.ErrNoRows {
+		w.WriteHeader(51, "Not found")
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(40, "Internal server error")
+		return
+	}
+
+	w.WriteHeader(30, "/lightning/invoice/"+hash)
+}
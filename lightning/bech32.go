@@ -0,0 +1,112 @@
+package lightning
+
+import (
+	"errors"
+	"strings"
+)
+
+// bech32 as in BIP173, without its 90 character limit which invoices and
+// LNURLs easily exceed
+
+const charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+var ErrInvalidBech32 = errors.New("Invalid bech32 string")
+
+var generator = [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+func polymod(values []byte) uint32 {
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+func hrpExpand(hrp string) []byte {
+	out := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]>>5)
+	}
+	out = append(out, 0)
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]&31)
+	}
+	return out
+}
+
+// DecodeBech32 returns the human readable part and the 5 bit groups of the
+// data part, without the checksum
+func DecodeBech32(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, ErrInvalidBech32
+	}
+	s = strings.ToLower(s)
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || sep+7 > len(s) {
+		return "", nil, ErrInvalidBech32
+	}
+	hrp := s[:sep]
+	data := make([]byte, 0, len(s)-sep-1)
+	for _, c := range s[sep+1:] {
+		i := strings.IndexRune(charset, c)
+		if i < 0 {
+			return "", nil, ErrInvalidBech32
+		}
+		data = append(data, byte(i))
+	}
+	if polymod(append(hrpExpand(hrp), data...)) != 1 {
+		return "", nil, ErrInvalidBech32
+	}
+	return hrp, data[:len(data)-6], nil
+}
+
+// EncodeBech32 is the inverse of DecodeBech32
+func EncodeBech32(hrp string, data []byte) string {
+	values := append(hrpExpand(hrp), data...)
+	mod := polymod(append(values, 0, 0, 0, 0, 0, 0)) ^ 1
+	var b strings.Builder
+	b.WriteString(hrp)
+	b.WriteByte('1')
+	for _, d := range data {
+		b.WriteByte(charset[d])
+	}
+	for i := 0; i < 6; i++ {
+		b.WriteByte(charset[(mod>>uint(5*(5-i)))&31])
+	}
+	return b.String()
+}
+
+// ConvertBits regroups bits, e.g. 8 bit bytes into 5 bit groups
+func ConvertBits(data []byte, from, to uint, pad bool) ([]byte, error) {
+	var (
+		acc  uint32
+		bits uint
+		out  []byte
+	)
+	maxv := uint32(1)<<to - 1
+	for _, d := range data {
+		if uint32(d)>>from != 0 {
+			return nil, ErrInvalidBech32
+		}
+		acc = acc<<from | uint32(d)
+		bits += from
+		for bits >= to {
+			bits -= to
+			out = append(out, byte(acc>>bits&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			out = append(out, byte(acc<<(to-bits)&maxv))
+		}
+	} else if bits >= from || acc<<(to-bits)&maxv != 0 {
+		return nil, ErrInvalidBech32
+	}
+	return out, nil
+}
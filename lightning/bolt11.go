@@ -0,0 +1,161 @@
+package lightning
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidInvoice = errors.New("Invalid BOLT11 invoice")
+
+// Invoice holds the fields of a BOLT11 payment request gemmit cares about.
+// The signature isn't checked, the payee isn't known beforehand anyway.
+// What counts is the payment hash. Its preimage is revealed to whoever pays,
+// but the payee knows it from the start, so it proves nothing to anyone but
+// the payer.
+type Invoice struct {
+	Network         string // bc, tb, bcrt, ...
+	Amount          uint64 // millisatoshi, 0 if the invoice has none
+	Timestamp       time.Time
+	Expiry          time.Duration
+	PaymentHash     string
+	DescriptionHash string
+	Description     string
+}
+
+// field types, BOLT11 tagged fields
+const (
+	fieldPaymentHash     = 1
+	fieldDescription     = 13
+	fieldExpiry          = 6
+	fieldDescriptionHash = 23
+)
+
+// signature is 65 bytes, in 5 bit groups
+const signatureLen = 104
+
+func DecodeInvoice(s string) (*Invoice, error) {
+	s = strings.TrimPrefix(strings.ToLower(s), "lightning:")
+	hrp, data, err := DecodeBech32(s)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(hrp, "ln") || len(data) < 7+signatureLen {
+		return nil, ErrInvalidInvoice
+	}
+	hrp = hrp[2:]
+	i := strings.IndexAny(hrp, "0123456789")
+	if i < 0 {
+		i = len(hrp)
+	}
+	inv := &Invoice{
+		Network: hrp[:i],
+		Expiry:  time.Hour,
+	}
+	if inv.Amount, err = parseAmount(hrp[i:]); err != nil {
+		return nil, err
+	}
+
+	data = data[:len(data)-signatureLen]
+	inv.Timestamp = time.Unix(int64(readInt(data[:7])), 0).UTC()
+	data = data[7:]
+	for len(data) >= 3 {
+		tag, length := data[0], int(readInt(data[1:3]))
+		data = data[3:]
+		if length > len(data) {
+			return nil, ErrInvalidInvoice
+		}
+		field := data[:length]
+		data = data[length:]
+
+		switch tag {
+		case fieldPaymentHash, fieldDescriptionHash:
+			// fields of an unexpected length are skipped, as BOLT11 says
+			if length != 52 {
+				continue
+			}
+			b, err := ConvertBits(field, 5, 8, false)
+			if err != nil {
+				return nil, ErrInvalidInvoice
+			}
+			if tag == fieldPaymentHash {
+				inv.PaymentHash = hex.EncodeToString(b)
+			} else {
+				inv.DescriptionHash = hex.EncodeToString(b)
+			}
+		case fieldDescription:
+			b, err := ConvertBits(field, 5, 8, false)
+			if err != nil {
+				return nil, ErrInvalidInvoice
+			}
+			inv.Description = string(b)
+		case fieldExpiry:
+			inv.Expiry = time.Duration(readInt(field)) * time.Second
+		}
+	}
+	if inv.PaymentHash == "" {
+		return nil, ErrInvalidInvoice
+	}
+	return inv, nil
+}
+
+func (inv *Invoice) Expires() time.Time {
+	return inv.Timestamp.Add(inv.Expiry)
+}
+
+// parseAmount converts the amount of the human readable part to
+// millisatoshi, the multiplier divides a whole bitcoin
+func parseAmount(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	msat := uint64(100000000000)
+	divisor := uint64(1)
+	switch s[len(s)-1] {
+	case 'm':
+		divisor = 1000
+	case 'u':
+		divisor = 1000000
+	case 'n':
+		divisor = 1000000000
+	case 'p':
+		divisor = 1000000000000
+	}
+	if divisor > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidInvoice
+	}
+	if divisor > msat {
+		// pico bitcoin are tenths of a millisatoshi
+		if n%10 != 0 {
+			return 0, ErrInvalidInvoice
+		}
+		return n / 10, nil
+	}
+	return n * (msat / divisor), nil
+}
+
+func readInt(groups []byte) uint64 {
+	var n uint64
+	for _, g := range groups {
+		n = n<<5 | uint64(g)
+	}
+	return n
+}
+
+// CheckPreimage tells if preimage is the proof of payment for paymentHash,
+// both hex encoded
+func CheckPreimage(paymentHash, preimage string) bool {
+	b, err := hex.DecodeString(preimage)
+	if err != nil || len(b) != 32 {
+		return false
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]) == strings.ToLower(paymentHash)
+}
@@ -0,0 +1,287 @@
+package lightning
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrInvalidLNURL = errors.New("Not an LNURL or Lightning address")
+	errLNURLScheme  = errors.New("LNURL must use https")
+)
+
+// Endpoint returns the LNURL-pay URL of a payment request, which is either
+// a bech32 encoded LNURL or a Lightning address, user@domain
+func Endpoint(s string) (string, error) {
+	if len(s) > 10 && strings.EqualFold(s[:10], "lightning:") {
+		s = s[10:]
+	}
+	if i := strings.IndexByte(s, '@'); i >= 0 {
+		user, domain := s[:i], s[i+1:]
+		if user == "" || domain == "" || strings.ContainsAny(user+domain, "/?#@") {
+			return "", ErrInvalidLNURL
+		}
+		u := &url.URL{
+			Scheme: "https",
+			Host:   domain,
+			Path:   "/.well-known/lnurlp/" + user,
+		}
+		return u.String(), nil
+	}
+
+	hrp, data, err := DecodeBech32(s)
+	if err != nil || hrp != "lnurl" {
+		return "", ErrInvalidLNURL
+	}
+	b, err := ConvertBits(data, 5, 8, false)
+	if err != nil {
+		return "", ErrInvalidLNURL
+	}
+	u, err := url.Parse(string(b))
+	if err != nil {
+		return "", ErrInvalidLNURL
+	}
+	if u.Scheme != "https" {
+		return "", errLNURLScheme
+	}
+	return u.String(), nil
+}
+
+// PayRequest is the first response of an LNURL-pay endpoint, LUD-06
+type PayRequest struct {
+	Tag         string `json:"tag"`
+	Callback    string `json:"callback"`
+	MinSendable uint64 `json:"minSendable"` // millisatoshi
+	MaxSendable uint64 `json:"maxSendable"`
+	Metadata    string `json:"metadata"`
+}
+
+// InvoiceResponse is the callback's answer to an invoice request
+type InvoiceResponse struct {
+	PR string `json:"pr"`
+	// Verify is where the payment status can be looked up, LUD-21. Empty
+	// when the author's server doesn't support it.
+	Verify  string   `json:"verify"`
+	Invoice *Invoice `json:"-"`
+}
+
+// Client talks to the LNURL-pay endpoints of authors. The URLs come from
+// the authors' feeds, so only https is spoken and only to public addresses.
+type Client struct {
+	HTTP *http.Client
+	// Network is the BOLT11 network invoices have to be for, bc for mainnet
+	Network string
+}
+
+// NewClient makes a client for invoices on network
+func NewClient(network string) *Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: publicOnly,
+	}
+	return &Client{
+		HTTP: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: 10 * time.Second,
+			},
+			CheckRedirect: httpsOnly,
+		},
+		Network: network,
+	}
+}
+
+// NewTestClient makes a client for regtest invoices which trusts any
+// certificate and local addresses, for testing with cmd/lnurlstub
+func NewTestClient() *Client {
+	return &Client{
+		HTTP: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+			CheckRedirect: httpsOnly,
+		},
+		Network: "bcrt",
+	}
+}
+
+// reserved are the private networks and others which aren't reachable on
+// the internet, net.IP.IsPrivate needs go 1.17
+var reserved = []*net.IPNet{
+	parseCIDR("10.0.0.0/8"),
+	parseCIDR("172.16.0.0/12"),
+	parseCIDR("192.168.0.0/16"),
+	parseCIDR("fc00::/7"),
+	parseCIDR("0.0.0.0/8"),
+	parseCIDR("100.64.0.0/10"), // carrier-grade NAT
+	parseCIDR("192.0.0.0/24"),
+	parseCIDR("198.18.0.0/15"),
+	parseCIDR("240.0.0.0/4"),
+}
+
+func parseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// publicOnly refuses to connect to loopback, private and link-local
+// addresses. It's called with the address a name resolved to, so names
+// pointing into the server's own network are refused as well.
+func publicOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("Lightning server address %s is not public", host)
+	}
+	for _, n := range reserved {
+		if n.Contains(ip) {
+			return fmt.Errorf("Lightning server address %s is not public", host)
+		}
+	}
+	return nil
+}
+
+func httpsOnly(req *http.Request, via []*http.Request) error {
+	if req.URL.Scheme != "https" {
+		return errLNURLScheme
+	}
+	if len(via) >= 10 {
+		return errors.New("Lightning server redirects too often")
+	}
+	return nil
+}
+
+func (c *Client) get(ctx context.Context, rawurl string, out interface{}) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	// LUD-06, callbacks and verify URLs included
+	if u.Scheme != "https" {
+		return errLNURLScheme
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("User-Agent", "gemmit (https://github.com/t-900-a/gemmit)")
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1048576)) // 1 MiB
+	if err != nil {
+		return err
+	}
+	// errors are reported in the body, often along with a 200
+	var status struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(body, &status); err == nil && strings.EqualFold(status.Status, "ERROR") {
+		return fmt.Errorf("Lightning server error: %s", status.Reason)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected Lightning server response %s", resp.Status)
+	}
+	return json.Unmarshal(body, out)
+}
+
+func (c *Client) PayRequest(ctx context.Context, endpoint string) (*PayRequest, error) {
+	var pr PayRequest
+	if err := c.get(ctx, endpoint, &pr); err != nil {
+		return nil, err
+	}
+	if pr.Tag != "payRequest" {
+		return nil, errors.New("Not an LNURL-pay endpoint")
+	}
+	if pr.MinSendable > pr.MaxSendable || pr.MaxSendable == 0 {
+		return nil, errors.New("LNURL-pay endpoint has no valid amount range")
+	}
+	return &pr, nil
+}
+
+// RequestInvoice asks for an invoice of amount millisatoshi and checks it
+// is the invoice that was asked for
+func (c *Client) RequestInvoice(ctx context.Context, pr *PayRequest, amount uint64) (*InvoiceResponse, error) {
+	if amount < pr.MinSendable || amount > pr.MaxSendable {
+		return nil, fmt.Errorf("Amount must be between %d and %d sats",
+			(pr.MinSendable+999)/1000, pr.MaxSendable/1000)
+	}
+	u, err := url.Parse(pr.Callback)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	query.Set("amount", strconv.FormatUint(amount, 10))
+	u.RawQuery = query.Encode()
+
+	var resp InvoiceResponse
+	if err := c.get(ctx, u.String(), &resp); err != nil {
+		return nil, err
+	}
+	inv, err := DecodeInvoice(resp.PR)
+	if err != nil {
+		return nil, err
+	}
+	if inv.Network != c.Network {
+		return nil, errors.New("Lightning server returned an invoice for another network")
+	}
+	if inv.Amount != amount {
+		return nil, errors.New("Lightning server returned an invoice for another amount")
+	}
+	sum := sha256.Sum256([]byte(pr.Metadata))
+	if inv.DescriptionHash != hex.EncodeToString(sum[:]) {
+		return nil, errors.New("Lightning server returned an invoice for another description")
+	}
+	resp.Invoice = inv
+	return &resp, nil
+}
+
+// Verify looks up whether the author's server says the invoice with
+// paymentHash was paid, along with the preimage. The server made the
+// invoice, so neither is proof the payment happened.
+func (c *Client) Verify(ctx context.Context, verifyURL, paymentHash string) (bool, error) {
+	var status struct {
+		Settled  bool   `json:"settled"`
+		Preimage string `json:"preimage"`
+	}
+	if err := c.get(ctx, verifyURL, &status); err != nil {
+		return false, err
+	}
+	if !status.Settled {
+		return false, nil
+	}
+	if status.Preimage == "" {
+		return false, errors.New("Lightning server reported a payment without its preimage")
+	}
+	if !CheckPreimage(paymentHash, status.Preimage) {
+		return false, errors.New("Lightning server reported a wrong preimage")
+	}
+	return true, nil
+}
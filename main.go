@@ -3,30 +3,74 @@ package main
 import (
 	"context"
 	"database/sql"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
 	"time"
 
 	"github.com/t-900-a/gemmit/feeds"
+	"github.com/t-900-a/gemmit/lightning"
+	"github.com/t-900-a/gemmit/viewkeys"
 
 	"git.sr.ht/~adnano/go-gemini"
 	"git.sr.ht/~adnano/go-gemini/certificate"
 	_ "github.com/jackc/pgx/v4/stdlib"
 )
 
+var viewKeyPublic *viewkeys.PublicKey
+
+// sealViewKey encrypts a view key before it's stored, it is kept as it is
+// without a public key. No view key stays empty.
+func sealViewKey(viewKey string) (string, error) {
+	if viewKeyPublic == nil || viewKey == "" {
+		return viewKey, nil
+	}
+	return viewkeys.Seal(viewKeyPublic, viewKey)
+}
+
 func main() {
-	hostname := os.Args[1]
+	flag.DurationVar(&hotDecay.VoteHalfLife, "hot-vote-half-life", hotDecay.VoteHalfLife,
+		"age at which a vote counts half on /hot")
+	flag.DurationVar(&hotDecay.PostHalfLife, "hot-post-half-life", hotDecay.PostHalfLife,
+		"time since a feed's latest entry at which its votes count half on /hot")
+	flag.StringVar(&scoring.Mode, "score", scoring.Mode,
+		"how votes add to the score: sum, sqrt, capped or log")
+	flag.Float64Var(&scoring.Cap, "score-cap", scoring.Cap,
+		"the most a single vote adds to the score in capped mode")
+	lightningTest := flag.Bool("lightning-test", false,
+		"ask cmd/lnurlstub for regtest invoices, trusting any certificate and local addresses")
+	flag.Parse()
+	if hotDecay.VoteHalfLife <= 0 || hotDecay.PostHalfLife <= 0 {
+		log.Fatal("Half lives must be positive")
+	}
+	if err := scoring.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if *lightningTest {
+		lightningClient = lightning.NewTestClient()
+	}
+
+	hostname := flag.Arg(0)
 	certpath := "/var/lib/gemini/certs"
-	cs := os.Args[2]
-	if len(os.Args) > 3 {
-		certpath = os.Args[3]
+	cs := flag.Arg(1)
+	if flag.NArg() > 2 {
+		certpath = flag.Arg(2)
 	}
 	db, err := sql.Open("pgx", cs)
 	if err != nil {
 		log.Fatalf("Failed to open a database connection: %v", err)
 	}
 
+	// view keys are sealed to this key, the private key stays with the scanners
+	viewKeyPublic, err = viewkeys.LoadPublicKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if viewKeyPublic == nil {
+		log.Printf("%s is not set, view keys will be stored unencrypted", viewkeys.PublicKeyEnv)
+	}
+
 	certificates := &certificate.Store{}
 	if err := certificates.Load(certpath); err != nil {
 		log.Fatal(err)
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/t-900-a/gemmit/cryptonote"
+	"github.com/t-900-a/gemmit/currency"
+	"github.com/t-900-a/gemmit/feeds"
+
+	"git.sr.ht/~adnano/go-gemini"
+	"github.com/t-900-a/rss"
+)
+
+// ManagedFeed is a feed as its author sees it
+type ManagedFeed struct {
+	ID       int
+	Title    string
+	URL      string
+	AuthorID int
+	// OwnsAuthor is set when the user claimed every feed of the author,
+	// only then may they change the author's payment methods
+	OwnsAuthor bool
+	Delisted   bool
+	Payments   []*ManagedPayment
+	Entries    []*ManagedEntry
+}
+
+type ManagedPayment struct {
+	ID       int
+	PayType  string
+	Currency *currency.Currency
+	Address  string
+	// NeedsViewKey is set for CryptoNote addresses whose votes can't be
+	// seen without a view key
+	NeedsViewKey bool
+	Retired      bool
+}
+
+type ManagedEntry struct {
+	ID        int
+	Title     string
+	URL       string
+	Published time.Time
+	Hidden    bool
+}
+
+var errNotAuthor = errors.New("Claim every feed of this author to change its payment methods")
+
+// loadManagedFeed looks up a feed the user has a verified claim to
+func loadManagedFeed(ctx context.Context, tx *sql.Tx, userID, feedID int) (*ManagedFeed, error) {
+	f := &ManagedFeed{ID: feedID}
+	row := tx.QueryRowContext(ctx, `
+		SELECT COALESCE(f.title, ''), COALESCE(f.url, ''), f.author_id, f.delisted,
+			NOT EXISTS (
+				SELECT 1 FROM feeds o
+				WHERE o.author_id = f.author_id AND NOT EXISTS (
+					SELECT 1 FROM feed_claims oc
+					WHERE oc.feed_id = o.id AND oc.user_id = $1
+						AND oc.verified IS NOT NULL
+				)
+			)
+		FROM feed_claims c
+		INNER JOIN feeds f ON c.feed_id = f.id
+		WHERE c.user_id = $1 AND c.feed_id = $2 AND c.verified IS NOT NULL;
+	`, userID, feedID)
+	if err := row.Scan(&f.Title, &f.URL, &f.AuthorID, &f.Delisted, &f.OwnsAuthor); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *ManagedFeed) loadPayments(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, pay_type, address, COALESCE(view_key, '') <> '', retired IS NOT NULL
+		FROM accepted_payments
+		WHERE author_id = $1
+		ORDER BY id;
+	`, f.AuthorID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			p       = &ManagedPayment{}
+			viewKey bool
+		)
+		if err := rows.Scan(&p.ID, &p.PayType, &p.Address, &viewKey, &p.Retired); err != nil {
+			return err
+		}
+		p.Currency = currency.ForPayType(p.PayType)
+		p.NeedsViewKey = !viewKey && cryptonote.CoinForPayType(p.PayType) != nil
+		f.Payments = append(f.Payments, p)
+	}
+	return rows.Err()
+}
+
+func (f *ManagedFeed) loadEntries(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, title, url, published, hidden
+		FROM entries
+		WHERE feed_id = $1
+		ORDER BY published DESC;
+	`, f.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := &ManagedEntry{}
+		if err := rows.Scan(&e.ID, &e.Title, &e.URL, &e.Published, &e.Hidden); err != nil {
+			return err
+		}
+		f.Entries = append(f.Entries, e)
+	}
+	return rows.Err()
+}
+
+// manageFeeds lists the feeds the user has claimed, /manage
+func manageFeeds(ctx context.Context, w gemini.ResponseWriter, r *gemini.Request) {
+	user := User(ctx)
+	if !requireCertificate(w, user) {
+		return
+	}
+
+	var claimed []*ManagedFeed
+	if err := feeds.WithTx(ctx, &sql.TxOptions{
+		ReadOnly: true,
+	}, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `
+			SELECT f.id, COALESCE(f.title, ''), COALESCE(f.url, ''), f.delisted
+			FROM feed_claims c
+			INNER JOIN feeds f ON c.feed_id = f.id
+			WHERE c.user_id = $1 AND c.verified IS NOT NULL
+			ORDER BY f.title;
+		`, user.ID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			f := &ManagedFeed{}
+			if err := rows.Scan(&f.ID, &f.Title, &f.URL, &f.Delisted); err != nil {
+				return err
+			}
+			claimed = append(claimed, f)
+		}
+		return rows.Err()
+	}); err != nil {
+		log.Println(err)
+		w.WriteHeader(40, "Internal server error")
+		return
+	}
+
+	w.WriteHeader(20, "text/gemini")
+	err := managePage.Execute(w, &ManagePage{
+		Feeds: claimed,
+		Logo:  gemmitLogo,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// manageFeed is where authors change a claimed feed, /manage/<feed id>
+// followed by what to do
+func manageFeed(ctx context.Context, w gemini.ResponseWriter, r *gemini.Request) {
+	user := User(ctx)
+	if !requireCertificate(w, user) {
+		return
+	}
+	feedID, action, ok := claimFeedID(r.URL.Path, "/manage/")
+	if !ok {
+		w.WriteHeader(51, "Not found")
+		return
+	}
+	back := "/manage/" + strconv.Itoa(feedID)
+
+	// actions on an entry or payment end with its id
+	target := 0
+	if i := strings.IndexByte(action, '/'); i >= 0 {
+		id, err := strconv.Atoi(action[i+1:])
+		if err != nil {
+			w.WriteHeader(51, "Not found")
+			return
+		}
+		action, target = action[:i], id
+	}
+
+	if action == "payment" {
+		addPayment(ctx, w, r, user, feedID)
+		return
+	}
+
+	var f *ManagedFeed
+	if err := feeds.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		var err error
+		f, err = loadManagedFeed(ctx, tx, user.ID, feedID)
+		if err != nil {
+			return err
+		}
+
+		switch action {
+		case "":
+			return f.loadPayments(ctx, tx)
+		case "entries":
+			return f.loadEntries(ctx, tx)
+		case "delist", "relist":
+			_, err = tx.ExecContext(ctx, `
+				UPDATE feeds SET delisted = $2 WHERE id = $1;
+			`, f.ID, action == "delist")
+		case "hide", "show":
+			back += "/entries"
+			_, err = tx.ExecContext(ctx, `
+				UPDATE entries SET hidden = $3 WHERE id = $1 AND feed_id = $2;
+			`, target, f.ID, action == "hide")
+		case "retire", "restore":
+			// payment methods belong to the author, which may have feeds
+			// claimed by someone else
+			if !f.OwnsAuthor {
+				return errNotAuthor
+			}
+			// votes already received keep counting, the account is just
+			// no longer scanned or offered to voters
+			_, err = tx.ExecContext(ctx, `
+				UPDATE accepted_payments
+				SET retired = CASE WHEN $3 THEN NOW() at time zone 'utc' END
+				WHERE id = $1 AND author_id = $2;
+			`, target, f.AuthorID, action == "retire")
+		default:
+			return sql.ErrNoRows
+		}
+		return err
+	}); err == sql.ErrNoRows {
+		if f == nil {
+			w.WriteHeader(30, "/claim/"+strconv.Itoa(feedID))
+		} else {
+			w.WriteHeader(51, "Not found")
+		}
+		return
+	} else if err == errNotAuthor {
+		w.WriteHeader(61, err.Error())
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(40, "Internal server error")
+		return
+	}
+
+	switch action {
+	case "":
+		w.WriteHeader(20, "text/gemini")
+		if err := manageFeedPage.Execute(w, &ManageFeedPage{
+			ManagedFeed: f,
+			Logo:        gemmitLogo,
+		}); err != nil {
+			panic(err)
+		}
+	case "entries":
+		w.WriteHeader(20, "text/gemini")
+		if err := manageEntriesPage.Execute(w, &ManageFeedPage{
+			ManagedFeed: f,
+			Logo:        gemmitLogo,
+		}); err != nil {
+			panic(err)
+		}
+	default:
+		w.WriteHeader(30, back)
+	}
+}
+
+// addPayment asks for a payment URI and adds it to the feed's author,
+// /manage/<feed id>/payment
+func addPayment(ctx context.Context, w gemini.ResponseWriter, r *gemini.Request, user *UserContext, feedID int) {
+	if r.URL.RawQuery == "" {
+		w.WriteHeader(10, "Payment URI, e.g. monero:<address>, bitcoin:<address or xpub> or lightning:<you@your-wallet.example>")
+		return
+	}
+	query, err := url.QueryUnescape(r.URL.RawQuery)
+	if err != nil {
+		w.WriteHeader(10, err.Error()+": Try again")
+		return
+	}
+	uri := strings.TrimSpace(query)
+	c := currency.ForURI(uri)
+	if c == nil {
+		w.WriteHeader(10, "Unsupported payment URI: Try again")
+		return
+	}
+	// the same checks as for payment links in feeds
+	added, err := parseAcceptedPayments(&rss.Author{
+		Extensions: []*rss.Link{{Rel: "payment", Type: c.PayType, Href: uri}},
+	})
+	if err != nil {
+		w.WriteHeader(10, err.Error()+": Try again")
+		return
+	}
+
+	taken := false
+	if err := feeds.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		f, err := loadManagedFeed(ctx, tx, user.ID, feedID)
+		if err != nil {
+			return err
+		}
+		if !f.OwnsAuthor {
+			return errNotAuthor
+		}
+		for _, p := range added {
+			// an address retired before comes back
+			result, err := tx.ExecContext(ctx, `
+				INSERT INTO accepted_payments (
+					author_id, pay_type, address, registered, scan_height, manual
+				) VALUES ($1, $2, $3, false, 0, true)
+				ON CONFLICT ON CONSTRAINT accepted_payments_address_key
+				DO UPDATE SET retired = NULL, manual = true
+				WHERE accepted_payments.author_id = EXCLUDED.author_id;
+			`, f.AuthorID, p.PayType, p.Address)
+			if err != nil {
+				return err
+			}
+			if n, err := result.RowsAffected(); err != nil {
+				return err
+			} else if n == 0 {
+				taken = true
+			}
+		}
+		return nil
+	}); err == sql.ErrNoRows {
+		w.WriteHeader(30, "/claim/"+strconv.Itoa(feedID))
+		return
+	} else if err == errNotAuthor {
+		w.WriteHeader(61, err.Error())
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(40, "Internal server error")
+		return
+	}
+	if taken {
+		w.WriteHeader(10, "That address belongs to another author: Try again")
+		return
+	}
+	w.WriteHeader(30, "/manage/"+strconv.Itoa(feedID))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pageSize is how many feeds or posts a list shows at once
+const pageSize = 10
+
+// timestampKey is how timestamps are written in cursors, to the
+// microsecond like postgres keeps them
+const timestampKey = "2006-01-02T15:04:05.999999"
+
+var errInvalidPage = errors.New("Invalid page")
+
+// Cursor is where a page starts: after the row with the sort key Key, or
+// before it when going back
+type Cursor struct {
+	Before bool
+	Key    []string
+	// At is the time the rows were ranked as of, sort keys that change
+	// with time are only comparable for the same At. Zero for lists that
+	// don't age.
+	At time.Time
+}
+
+// parseCursor reads the cursor of a page from the query, nil for the first
+// page
+func parseCursor(rawQuery string) (*Cursor, error) {
+	if rawQuery == "" {
+		return nil, nil
+	}
+	query, err := url.QueryUnescape(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cursor{}
+	switch {
+	case strings.HasPrefix(query, "after:"):
+		query = strings.TrimPrefix(query, "after:")
+	case strings.HasPrefix(query, "before:"):
+		c.Before, query = true, strings.TrimPrefix(query, "before:")
+	default:
+		return nil, errInvalidPage
+	}
+	if i := strings.LastIndexByte(query, '@'); i >= 0 {
+		if c.At, err = time.Parse(timestampKey, query[i+1:]); err != nil {
+			return nil, errInvalidPage
+		}
+		query = query[:i]
+	}
+	c.Key = strings.Split(query, ",")
+	return c, nil
+}
+
+// entryKey is the sort key of an entry in the latest posts
+func entryKey(e *Entry) []string {
+	return []string{e.Published.Format(timestampKey), strconv.Itoa(e.ID)}
+}
+
+func (c *Cursor) String() string {
+	s := "after:"
+	if c.Before {
+		s = "before:"
+	}
+	s += strings.Join(c.Key, ",")
+	if !c.At.IsZero() {
+		s += "@" + c.At.Format(timestampKey)
+	}
+	return url.QueryEscape(s)
+}
+
+// compare is the condition on the sort key columns for the rows of the page
+// and the order fetching them, descending unless going back. Placeholders
+// start at $n and are cast to types.
+func (c *Cursor) compare(columns, types []string, n int) (where, order string) {
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = "$" + strconv.Itoa(n+i) + "::" + types[i]
+	}
+	direction, sign := "DESC", "<"
+	if c != nil && c.Before {
+		direction, sign = "ASC", ">"
+	}
+	order = strings.Join(columns, " "+direction+", ") + " " + direction
+	if c == nil {
+		return "true", order
+	}
+	return "(" + strings.Join(columns, ", ") + ") " + sign + " (" + strings.Join(placeholders, ", ") + ")", order
+}
+
+// args are the cursor's key for compare, checked against the types of the
+// columns
+func (c *Cursor) args(types []string) ([]interface{}, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if len(c.Key) != len(types) {
+		return nil, errInvalidPage
+	}
+	args := make([]interface{}, len(c.Key))
+	for i, k := range c.Key {
+		var err error
+		switch types[i] {
+		case "numeric":
+			_, err = strconv.ParseFloat(k, 64)
+		case "bigint", "integer":
+			_, err = strconv.ParseInt(k, 10, 64)
+		case "timestamp":
+			_, err = time.Parse(timestampKey, k)
+		}
+		if err != nil {
+			return nil, errInvalidPage
+		}
+		args[i] = k
+	}
+	return args, nil
+}
+
+// Page links the pages around the one shown
+type Page struct {
+	Path     string
+	Next     string
+	Previous string
+	// First is set past the first page
+	First bool
+	Total int
+}
+
+// newPage works out which pages there are around one. more tells if a row
+// beyond the page was fetched, first and last are the sort keys of the
+// rows shown, ranked as of at.
+func newPage(path string, c *Cursor, more bool, first, last []string, total int, at time.Time) *Page {
+	p := &Page{Path: path, First: c != nil, Total: total}
+	next, previous := more, c != nil
+	if c != nil && c.Before {
+		next, previous = true, more
+	}
+	if first == nil {
+		return p
+	}
+	if next {
+		p.Next = (&Cursor{Key: last, At: at}).String()
+	}
+	if previous {
+		p.Previous = (&Cursor{Before: true, Key: first, At: at}).String()
+	}
+	return p
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/t-900-a/gemmit/bitcoin"
+	"github.com/t-900-a/gemmit/cryptonote"
+	"github.com/t-900-a/gemmit/lightning"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/t-900-a/rss"
+)
+
+var paymentRequestType = regexp.MustCompile(`application\/.+-paymentrequest`)
+
+// bitcoinNetwork is the network scanned for Bitcoin votes
+var bitcoinNetwork = &chaincfg.MainNetParams
+
+// parseAcceptedPayments finds the payment requests within the author
+// extensions of a feed. Errors are meant to be shown to the submitter.
+func parseAcceptedPayments(author *rss.Author) ([]*AcceptedPayment, error) {
+	// go doesn't allow arrays of arbitrary length
+	// arbitrarily capping the max accepted payments to 15
+	accepted_payments := make([]*AcceptedPayment, 0, 15)
+	for _, ext := range author.Extensions {
+		pymnt, err := parseAcceptedPayment(author, ext)
+		if err != nil {
+			return nil, err
+		}
+		if pymnt != nil {
+			accepted_payments = append(accepted_payments, pymnt)
+		}
+	}
+	if len(accepted_payments) < 1 {
+		return nil, errors.New("Failed to process Author's accepted payments")
+	}
+	return accepted_payments, nil
+}
+
+// parseAcceptedPayment reads a single payment request, nil if the extension
+// is none
+// if the payment request is not a cryptonote one (monero, wownero, ...), then it is taken as is
+// otherwise the view key of the same coin is looked for within the extensions
+// both view key and address are accepted together
+func parseAcceptedPayment(author *rss.Author, outer_ext *rss.Link) (*AcceptedPayment, error) {
+	if !paymentRequestType.MatchString(outer_ext.Type) {
+		return nil, nil
+	}
+	split_index := strings.Index(outer_ext.Href, ":")
+	if split_index < 0 {
+		return nil, errors.New("Author's payment data within feed is malformed")
+	}
+	address := outer_ext.Href[split_index+1:]
+	if outer_ext.Type == "application/bitcoin-paymentrequest" {
+		address, err := validateBitcoinWallet(address)
+		if err != nil {
+			return nil, err
+		}
+		return &AcceptedPayment{
+			PayType:    outer_ext.Type,
+			ViewKey:    "",
+			Address:    address,
+			Registered: false,
+		}, nil
+	}
+	if outer_ext.Type == "application/lightning-paymentrequest" {
+		if _, err := lightning.Endpoint(address); err != nil {
+			return nil, fmt.Errorf("Invalid Lightning payment request: %v", err)
+		}
+		return &AcceptedPayment{
+			PayType:    outer_ext.Type,
+			ViewKey:    "",
+			Address:    address,
+			Registered: false,
+		}, nil
+	}
+	coin := cryptonote.CoinForPayType(outer_ext.Type)
+	if coin == nil {
+		return &AcceptedPayment{
+			PayType:    outer_ext.Type,
+			ViewKey:    "",
+			Address:    outer_ext.Href,
+			Registered: false,
+		}, nil
+	}
+
+	addr, err := validateCryptoNoteAddress(coin, address)
+	if err != nil {
+		return nil, err
+	}
+	// the view key is best registered privately once the feed is
+	// claimed, older feeds publish it
+	viewKey := ""
+	for _, inner_ext := range author.Extensions {
+		if inner_ext.Type != coin.ViewKeyType() {
+			continue
+		}
+		viewKey, err = validateCryptoNoteViewKey(coin, addr, inner_ext.Href)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &AcceptedPayment{
+		PayType:    outer_ext.Type,
+		ViewKey:    viewKey,
+		Address:    address,
+		Registered: false,
+	}, nil
+}
+
+// PaymentCheck is what became of one of the author's links, for the
+// submitter to see before adding the feed
+type PaymentCheck struct {
+	Href    string
+	Payment *AcceptedPayment // nil unless it's a valid payment request
+	Problem string
+	Ignored bool
+}
+
+func isViewKeyType(t string) bool {
+	for _, c := range cryptonote.Coins {
+		if c.ViewKeyType() == t {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAcceptedPayments goes through every link of the author like
+// parseAcceptedPayments, but explains each instead of stopping at the
+// first error
+func checkAcceptedPayments(author *rss.Author) []*PaymentCheck {
+	var checks []*PaymentCheck
+	for _, ext := range author.Extensions {
+		check := &PaymentCheck{Href: ext.Href}
+		if ext.Rel != "payment" {
+			check.Problem = fmt.Sprintf("Link with rel=%q, only payment links are allowed", ext.Rel)
+		} else if pymnt, err := parseAcceptedPayment(author, ext); err != nil {
+			check.Problem = err.Error()
+		} else if pymnt != nil {
+			check.Payment = pymnt
+		} else if isViewKeyType(ext.Type) {
+			// shown along with its address
+			continue
+		} else {
+			check.Ignored = true
+			check.Problem = fmt.Sprintf("Type %q is not a payment request", ext.Type)
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+func validateCryptoNoteAddress(coin *cryptonote.Coin, address string) (*cryptonote.Address, error) {
+	addr, err := coin.DecodeAddress(address)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s address: %v", coin.Name, err)
+	}
+	if addr.Network != coin.Network {
+		return nil, fmt.Errorf("%s address is a %s %s, expected %s",
+			coin.Name, addr.Network.Name, addr.Kind, coin.Network.Name)
+	}
+	return addr, nil
+}
+
+// validateCryptoNoteViewKey checks that the private view key belongs to addr,
+// a mismatched key would otherwise never find a single vote
+func validateCryptoNoteViewKey(coin *cryptonote.Coin, addr *cryptonote.Address, href string) (string, error) {
+	// accept both a bare key and monero-viewkey:<key>
+	viewKey := href[strings.Index(href, ":")+1:]
+	secret, err := cryptonote.ParseSecretKey(viewKey)
+	if err != nil {
+		return "", fmt.Errorf("%s view key must be 64 hex characters", coin.Name)
+	}
+	if !addr.MatchesViewKey(secret) {
+		return "", fmt.Errorf("%s view key does not belong to the %s address", coin.Name, coin.Name)
+	}
+	return viewKey, nil
+}
+
+// validateBitcoinWallet accepts a single address or the extended public key
+// of an account, query parameters of the URI are dropped
+func validateBitcoinWallet(address string) (string, error) {
+	address = bitcoin.StripURI(address)
+	if _, err := bitcoin.ParseWallet(address, bitcoinNetwork); err != nil {
+		return "", fmt.Errorf("Invalid Bitcoin payment request: %v", err)
+	}
+	return address, nil
+}
+
+// nullIfEmpty stores missing view keys as NULL, view keys are unique
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/t-900-a/gemmit/feeds"
+
+	"git.sr.ht/~adnano/go-gemini"
+	"github.com/t-900-a/rss"
+)
+
+// previewEntries is how many entries are shown before adding a feed
+const previewEntries = 5
+
+// FeedPreview is what gemmit understood from a feed before it is added
+type FeedPreview struct {
+	FeedURL  string
+	Kind     string
+	Feed     *rss.Feed
+	Author   *rss.Author
+	Entries  []*rss.Item
+	More     int // entries not shown
+	Payments []*PaymentCheck
+	Problems []string
+	// Known feeds are updated when confirming
+	Known bool
+}
+
+// CanAdd tells if confirming would add the feed
+func (p *FeedPreview) CanAdd() bool {
+	if len(p.Problems) > 0 {
+		return false
+	}
+	for _, check := range p.Payments {
+		if check.Payment != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Confirm is the query of the link adding the feed
+func (p *FeedPreview) Confirm() string {
+	return url.QueryEscape(p.FeedURL)
+}
+
+// previewFeed fetches a feed and shows what would be added, /add. Nothing
+// is stored until it's confirmed on /add/confirm.
+func previewFeed(ctx context.Context, w gemini.ResponseWriter, r *gemini.Request) {
+	if r.URL.RawQuery == "" {
+		w.WriteHeader(10, "Enter a feed URL")
+		return
+	}
+	query, err := url.QueryUnescape(r.URL.RawQuery)
+	if err != nil {
+		w.WriteHeader(10, err.Error()+": Try again")
+		return
+	}
+	feedURL, err := url.Parse(strings.TrimSpace(query))
+	if err != nil {
+		w.WriteHeader(10, err.Error()+": Try again")
+		return
+	}
+
+	feed, kind, err := feeds.FetchWithManifest(ctx, feedURL)
+	if err != nil {
+		w.WriteHeader(10, err.Error()+": Try again")
+		return
+	}
+
+	p := &FeedPreview{
+		FeedURL: feedURL.String(),
+		Kind:    kind,
+		Feed:    feed,
+		Author:  feed.Author,
+		Entries: feed.Items,
+	}
+	if len(p.Entries) > previewEntries {
+		p.Entries, p.More = p.Entries[:previewEntries], len(p.Entries)-previewEntries
+	}
+	if feed.Author == nil {
+		p.Problems = append(p.Problems, "The feed has no author, payment links go within the author element")
+	} else {
+		p.Payments = checkAcceptedPayments(feed.Author)
+		for _, check := range p.Payments {
+			if check.Problem != "" && !check.Ignored {
+				p.Problems = append(p.Problems, check.Href+": "+check.Problem)
+			}
+		}
+		if !p.CanAdd() && len(p.Problems) == 0 {
+			p.Problems = append(p.Problems, "No accepted payments found within the feed")
+		}
+	}
+
+	if err := feeds.WithTx(ctx, &sql.TxOptions{
+		ReadOnly: true,
+	}, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, `
+			SELECT EXISTS (
+				SELECT 1 FROM feeds WHERE feed_url = $1
+			);
+		`, p.FeedURL)
+		return row.Scan(&p.Known)
+	}); err != nil {
+		log.Println(err)
+		w.WriteHeader(40, "Internal server error")
+		return
+	}
+
+	w.WriteHeader(20, "text/gemini")
+	err = feedPreviewPage.Execute(w, &FeedPreviewPage{
+		FeedPreview: p,
+		Logo:        gemmitLogo,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
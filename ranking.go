@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/t-900-a/gemmit/currency"
+	"github.com/t-900-a/gemmit/feeds"
+
+	"git.sr.ht/~adnano/go-gemini"
+)
+
+// HotDecay is how fast feeds cool down on /hot. Votes lose half their
+// weight every VoteHalfLife, a feed loses half of its votes' weight every
+// PostHalfLife since its latest entry.
+type HotDecay struct {
+	VoteHalfLife time.Duration
+	PostHalfLife time.Duration
+}
+
+// hotDecay is set by the -hot-vote-half-life and -hot-post-half-life flags
+var hotDecay = &HotDecay{
+	VoteHalfLife: 3 * 24 * time.Hour,
+	PostHalfLife: 7 * 24 * time.Hour,
+}
+
+// Ranking is an ordered list of feeds
+type Ranking struct {
+	Title string
+	// Hot decays the votes by age, nil ranks by all votes received within
+	// the window
+	Hot *HotDecay
+	// Window only counts the votes paid within it, all of them if zero
+	Window time.Duration
+	// EntriesTitle is set to rank the posts as well
+	EntriesTitle string
+}
+
+var (
+	hotRanking = &Ranking{Title: "Hot Feeds", Hot: hotDecay}
+	topRanking = &Ranking{Title: "Top Feeds of all time"}
+
+	// windowRankings are served as /top/<name>
+	windowRankings = map[string]*Ranking{
+		"day": {Title: "Top Feeds of the day", EntriesTitle: "Top 10 Posts of the day",
+			Window: 24 * time.Hour},
+		"week": {Title: "Top Feeds of the week", EntriesTitle: "Top 10 Posts of the week",
+			Window: 7 * 24 * time.Hour},
+		"month": {Title: "Top Feeds of the month", EntriesTitle: "Top 10 Posts of the month",
+			Window: 30 * 24 * time.Hour},
+		"year": {Title: "Top Feeds of the year", EntriesTitle: "Top 10 Posts of the year",
+			Window: 365 * 24 * time.Hour},
+	}
+)
+
+// since is when the window ranked as of now starts, zero for all time
+func (r *Ranking) since(now time.Time) time.Time {
+	if r.Window == 0 {
+		return time.Time{}
+	}
+	return now.Add(-r.Window)
+}
+
+// rankFeeds lists a page of the feeds of a ranking with their votes
+func rankFeeds(ctx context.Context, tx *sql.Tx, ranking *Ranking, path string, cursor *Cursor) ([]*Feed, *Page, error) {
+	// the ranking changes with time, later pages go on ranking as of the
+	// time of the first one, or they'd skip or repeat feeds
+	now := time.Now().UTC()
+	if cursor != nil && !cursor.At.IsZero() {
+		now = cursor.At
+	}
+	since := ranking.since(now)
+	args := append(currencyArgs(), currency.Lightning.PayType, since, now.Format(timestampKey))
+	// every vote weighs one plus its weighted score, halving with age
+	hot := "NULL::numeric"
+	// feeds rank by score, by the number of votes without prices
+	rank := "COALESCE(votes.score, 0)"
+	if ranking.Hot != nil {
+		args = append(args, ranking.Hot.VoteHalfLife.Seconds(), ranking.Hot.PostHalfLife.Seconds())
+		// the exponents are capped, a weight that small is as good as zero
+		hot = `sum((1 + COALESCE(weighted, 0)) *
+			0.5 ^ LEAST(extract(epoch FROM $6::timestamp - tx_date) / $7, 100))`
+		rank = `COALESCE(votes.hot, 0) *
+			0.5 ^ LEAST(extract(epoch FROM $6::timestamp - COALESCE(latest.published, f.created)) / $8, 100)`
+	}
+	// the id breaks ties, a page has to start at a single feed
+	types := []string{"numeric", "bigint", "integer"}
+	where, order := cursor.compare([]string{"rank", "count", "id"}, types, len(args)+1)
+	keys, err := cursor.args(types)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		WITH votes AS (
+			SELECT author_id, count(*) AS count, sum(weighted) AS score, `+hot+` AS hot
+			FROM (`+valuedPayments("payments")+`) v
+			WHERE tx_date >= $5 AND tx_date <= $6::timestamp
+			GROUP BY author_id
+		), ranked AS (
+			SELECT
+				f.id, f.title, f.description, f.url, a.name, f.updated, f.author_id,
+				EXISTS (SELECT 1 FROM accepted_payments ap
+					WHERE ap.author_id = f.author_id AND ap.pay_type = $4 AND ap.retired IS NULL)
+					AS lightning,
+				(`+rank+`)::numeric AS rank, COALESCE(votes.count, 0) AS count
+			FROM feeds f
+			INNER JOIN authors a ON f.author_id = a.id
+			LEFT JOIN votes ON votes.author_id = f.author_id
+			LEFT JOIN LATERAL (
+				SELECT max(e.published) AS published FROM entries e
+				WHERE e.feed_id = f.id AND NOT e.hidden
+			) latest ON true
+			WHERE approved = true AND NOT f.delisted
+		)
+		SELECT id, title, description, url, name, updated, author_id, lightning,
+			rank::text, count::text, id::text
+		FROM ranked
+		WHERE `+where+`
+		ORDER BY `+order+`
+		LIMIT `+strconv.Itoa(pageSize+1)+`;
+	`, append(args, keys...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		ranked  []*Feed
+		sortKey [][]string
+	)
+	for rows.Next() {
+		var (
+			feed = &Feed{}
+			key  = make([]string, 3)
+		)
+		if err := rows.Scan(&feed.ID, &feed.Title, &feed.Description, &feed.URL,
+			&feed.Author, &feed.Updated, &feed.AuthorID, &feed.Lightning,
+			&key[0], &key[1], &key[2]); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		ranked = append(ranked, feed)
+		sortKey = append(sortKey, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// one more feed than fits was asked for to tell if there are more
+	more := len(ranked) > pageSize
+	if more {
+		ranked, sortKey = ranked[:pageSize], sortKey[:pageSize]
+	}
+	if cursor != nil && cursor.Before {
+		for i, j := 0, len(ranked)-1; i < j; i, j = i+1, j-1 {
+			ranked[i], ranked[j] = ranked[j], ranked[i]
+			sortKey[i], sortKey[j] = sortKey[j], sortKey[i]
+		}
+	}
+
+	var total int
+	if err := tx.QueryRowContext(ctx, `
+		SELECT count(*) FROM feeds WHERE approved = true AND NOT delisted;
+	`).Scan(&total); err != nil {
+		return nil, nil, err
+	}
+	var first, last []string
+	if len(sortKey) > 0 {
+		first, last = sortKey[0], sortKey[len(sortKey)-1]
+	}
+	page := newPage(path, cursor, more, first, last, total, now)
+
+	authors := make([]int, 0, len(ranked))
+	for _, feed := range ranked {
+		authors = append(authors, feed.AuthorID)
+	}
+	votes, err := loadVotes(ctx, tx, "author_id", authors, since)
+	if err != nil {
+		return nil, nil, err
+	}
+	syncs, err := loadSyncs(ctx, tx, authors)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, feed := range ranked {
+		feed.Votes = votes[feed.AuthorID]
+		feed.Syncs = syncs[feed.AuthorID]
+	}
+	return ranked, page, nil
+}
+
+// rankEntries lists the top 10 posts of a ranking by the votes paid for
+// them, entries without votes of their own aren't ranked
+func rankEntries(ctx context.Context, tx *sql.Tx, ranking *Ranking) ([]*Entry, error) {
+	since := ranking.since(time.Now().UTC())
+	rows, err := tx.QueryContext(ctx, `
+		WITH votes AS (
+			SELECT entry_id, count(*) AS count, sum(weighted) AS score
+			FROM (`+valuedPayments("payments")+`) v
+			WHERE entry_id IS NOT NULL AND tx_date >= $4
+			GROUP BY entry_id
+		)
+		SELECT
+			e.id, e.title, f.title, e.published, e.url, f.author_id
+		FROM votes
+		INNER JOIN entries e ON e.id = votes.entry_id
+		INNER JOIN feeds f ON e.feed_id = f.id
+		WHERE approved = true AND NOT f.delisted AND NOT e.hidden
+		ORDER BY COALESCE(votes.score, 0) DESC, votes.count DESC, e.published DESC
+		LIMIT 10;
+	`, append(currencyArgs(), since)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		ranked       []*Entry
+		ids, authors []int
+	)
+	for rows.Next() {
+		entry := &Entry{}
+		if err := rows.Scan(&entry.ID, &entry.Title, &entry.Feed, &entry.Published,
+			&entry.URL, &entry.AuthorID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ranked = append(ranked, entry)
+		ids = append(ids, entry.ID)
+		authors = append(authors, entry.AuthorID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	votes, err := loadVotes(ctx, tx, "author_id", authors, since)
+	if err != nil {
+		return nil, err
+	}
+	entryVotes, err := loadVotes(ctx, tx, "entry_id", ids, since)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range ranked {
+		entry.Votes = votes[entry.AuthorID]
+		entry.EntryVotes = entryVotes[entry.ID]
+	}
+	return ranked, nil
+}
+
+// showRanking is the dashboard listing the feeds of a ranking, the top
+// posts are shown with the first page
+func showRanking(ranking *Ranking) func(context.Context, gemini.ResponseWriter, *gemini.Request) {
+	return func(ctx context.Context, w gemini.ResponseWriter, r *gemini.Request) {
+		cursor, err := parseCursor(r.URL.RawQuery)
+		if err != nil {
+			w.WriteHeader(59, err.Error())
+			return
+		}
+
+		var (
+			ranked  []*Feed
+			entries []*Entry
+			page    *Page
+		)
+		if err := feeds.WithTx(ctx, &sql.TxOptions{
+			Isolation: 0,
+			ReadOnly:  true,
+		}, func(tx *sql.Tx) error {
+			var err error
+			if ranked, page, err = rankFeeds(ctx, tx, ranking, r.URL.Path, cursor); err != nil {
+				return err
+			}
+			if ranking.EntriesTitle != "" && cursor == nil {
+				entries, err = rankEntries(ctx, tx, ranking)
+			}
+			return err
+		}); err == errInvalidPage {
+			w.WriteHeader(59, err.Error())
+			return
+		} else if err != nil {
+			log.Println(err)
+			w.WriteHeader(40, "Internal server error")
+			return
+		}
+
+		w.WriteHeader(20, "text/gemini")
+		err = dashboardPage.Execute(w, &DashboardPage{
+			Ranking: ranking,
+			Feeds:   ranked,
+			Page:    page,
+			Entries: entries,
+			Logo:    gemmitLogo,
+			Newline: "\n",
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+}
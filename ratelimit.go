@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter allows a key up to limit events within window
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	events map[string][]time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:  limit,
+		window: window,
+		events: make(map[string][]time.Time),
+	}
+}
+
+// allow records an event for key, unless key had its limit already. It
+// returns how long to wait then, 0 if the event is allowed.
+func (l *rateLimiter) allow(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// keys that went quiet are dropped now and then
+	if len(l.events) > 10000 {
+		for k, events := range l.events {
+			if now.Sub(events[len(events)-1]) >= l.window {
+				delete(l.events, k)
+			}
+		}
+	}
+
+	var recent []time.Time
+	for _, t := range l.events[key] {
+		if now.Sub(t) < l.window {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= l.limit {
+		l.events[key] = recent
+		return l.window - now.Sub(recent[0])
+	}
+	l.events[key] = append(recent, now)
+	return 0
+}
@@ -3,114 +3,137 @@ package main
 import (
 	"context"
 	"database/sql"
-	"errors"
 	"log"
 	"net/url"
-	"regexp"
-	"strings"
+	"strconv"
+	"time"
 
 	"github.com/t-900-a/gemmit/feeds"
 
 	"git.sr.ht/~adnano/go-gemini"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/stdlib"
 )
 
 func configureRoutes() *gemini.ServeMux {
 	mux := &gemini.ServeMux{}
 
-	mux.HandleFunc("/", func(ctx context.Context, w gemini.ResponseWriter, r *gemini.Request) {
-		var top_feeds []*Feed
+	// hot feeds are the front page
+	mux.HandleFunc("/", showRanking(hotRanking))
+	mux.HandleFunc("/hot", showRanking(hotRanking))
+	mux.HandleFunc("/top", showRanking(topRanking))
+	for name, ranking := range windowRankings {
+		mux.HandleFunc("/top/"+name, showRanking(ranking))
+	}
+
+	mux.HandleFunc("/browse", func(ctx context.Context, w gemini.ResponseWriter, r *gemini.Request) {
+		cursor, err := parseCursor(r.URL.RawQuery)
+		if err != nil {
+			w.WriteHeader(59, err.Error())
+			return
+		}
+
+		var (
+			latest_entries []*Entry
+			page           *Page
+		)
 		if err := feeds.WithTx(ctx, &sql.TxOptions{
 			Isolation: 0,
 			ReadOnly:  true,
 		}, func(tx *sql.Tx) error {
+			// the id breaks ties, a page has to start at a single entry
+			types := []string{"timestamp", "integer"}
+			where, order := cursor.compare([]string{"e.published", "e.id"}, types, 1)
+			keys, err := cursor.args(types)
+			if err != nil {
+				return err
+			}
 			rows, err := tx.QueryContext(ctx, `
 				SELECT
-					f.title, f.description, f.url, a.name, f.updated, COALESCE(votes.count, 0), COALESCE(votes.amount, 0)
+					e.id, e.title, f.title, e.published, e.url, f.author_id
 				FROM feeds f
+				INNER JOIN entries e ON e.feed_id = f.id
 				INNER JOIN authors a ON f.author_id = a.id
-				LEFT JOIN (SELECT ap.author_id, count(*) as count, sum(p.amount) as amount
-				FROM payments p, accepted_payments ap
-				WHERE p.accepted_payments_id = ap.id
-				GROUP BY ap.author_id) as votes ON votes.author_id = f.author_id
-				WHERE approved = true
-				ORDER BY votes.count DESC
-				LIMIT 10;
-			`)
+				WHERE approved = true AND NOT f.delisted AND NOT e.hidden AND `+where+`
+				ORDER BY `+order+`
+				LIMIT `+strconv.Itoa(pageSize+1)+`;
+			`, keys...)
 			if err != nil {
 				return err
 			}
 
 			for rows.Next() {
-				feed := &Feed{}
-				if err := rows.Scan(&feed.Title, &feed.Description, &feed.URL,
-					&feed.Author, &feed.Updated, &feed.VoteCnt, &feed.VoteAmt); err != nil {
+				entry := &Entry{}
+				if err := rows.Scan(&entry.ID, &entry.Title, &entry.Feed, &entry.Published,
+					&entry.URL, &entry.AuthorID); err != nil {
+					rows.Close()
 					return err
 				}
-				top_feeds = append(top_feeds, feed)
+				latest_entries = append(latest_entries, entry)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
 			}
 
-			return nil
-		}); err != nil {
-			log.Println(err)
-			w.WriteHeader(40, "Internal server error")
-			return
-		}
-
-		w.WriteHeader(20, "text/gemini")
-		err := dashboardPage.Execute(w, &DashboardPage{
-			Feeds:   top_feeds,
-			Logo:    gemmitLogo,
-			Newline: "\n",
-		})
-		if err != nil {
-			panic(err)
-		}
-	})
+			// one more entry than fits was asked for to tell if there are more
+			more := len(latest_entries) > pageSize
+			if more {
+				latest_entries = latest_entries[:pageSize]
+			}
+			if cursor != nil && cursor.Before {
+				for i, j := 0, len(latest_entries)-1; i < j; i, j = i+1, j-1 {
+					latest_entries[i], latest_entries[j] = latest_entries[j], latest_entries[i]
+				}
+			}
 
-	mux.HandleFunc("/browse", func(ctx context.Context, w gemini.ResponseWriter, r *gemini.Request) {
-		var latest_entries []*Entry
-		if err := feeds.WithTx(ctx, &sql.TxOptions{
-			Isolation: 0,
-			ReadOnly:  true,
-		}, func(tx *sql.Tx) error {
-			rows, err := tx.QueryContext(ctx, `
-				SELECT
-					e.title, f.title, e.published, e.url, COALESCE(votes.count, 0), COALESCE(votes.amount, 0)
+			var total int
+			if err := tx.QueryRowContext(ctx, `
+				SELECT count(*)
 				FROM feeds f
 				INNER JOIN entries e ON e.feed_id = f.id
-				INNER JOIN authors a ON f.author_id = a.id
-				LEFT JOIN (SELECT ap.author_id, count(*) as count, sum(p.amount) as amount
-				FROM payments p, accepted_payments ap
-				WHERE p.accepted_payments_id = ap.id
-				GROUP BY ap.author_id) as votes ON votes.author_id = f.author_id
-				WHERE approved = true
-				ORDER BY e.published DESC
-				LIMIT 10;
-			`)
-			if err != nil {
+				WHERE approved = true AND NOT f.delisted AND NOT e.hidden;
+			`).Scan(&total); err != nil {
 				return err
 			}
+			var first, last []string
+			if n := len(latest_entries); n > 0 {
+				first, last = entryKey(latest_entries[0]), entryKey(latest_entries[n-1])
+			}
+			page = newPage(r.URL.Path, cursor, more, first, last, total, time.Time{})
 
-			for rows.Next() {
-				entry := &Entry{}
-				if err := rows.Scan(&entry.Title, &entry.Feed, &entry.Published,
-					&entry.URL, &entry.VoteCnt, &entry.VoteAmt); err != nil {
-					return err
-				}
-				latest_entries = append(latest_entries, entry)
+			var ids, authors []int
+			for _, entry := range latest_entries {
+				ids = append(ids, entry.ID)
+				authors = append(authors, entry.AuthorID)
+			}
+			votes, err := loadVotes(ctx, tx, "author_id", authors, time.Time{})
+			if err != nil {
+				return err
+			}
+			entryVotes, err := loadVotes(ctx, tx, "entry_id", ids, time.Time{})
+			if err != nil {
+				return err
+			}
+			for _, entry := range latest_entries {
+				entry.Votes = votes[entry.AuthorID]
+				entry.EntryVotes = entryVotes[entry.ID]
 			}
 
 			return nil
-		}); err != nil {
+		}); err == errInvalidPage {
+			w.WriteHeader(59, err.Error())
+			return
+		} else if err != nil {
 			log.Println(err)
 			w.WriteHeader(40, "Internal server error")
 			return
 		}
 
 		w.WriteHeader(20, "text/gemini")
-		err := browsePage.Execute(w, &BrowsePage{
+		err = browsePage.Execute(w, &BrowsePage{
 			Entries: latest_entries,
+			Page:    page,
 			Logo:    gemmitLogo,
 			Newline: "\n",
 		})
@@ -119,45 +142,56 @@ func configureRoutes() *gemini.ServeMux {
 		}
 	})
 
-	mux.HandleFunc("/add", func(ctx context.Context, w gemini.ResponseWriter, r *gemini.Request) {
+	mux.HandleFunc("/add", previewFeed)
+	// adds the feed previewed on /add
+	mux.HandleFunc("/add/confirm", func(ctx context.Context, w gemini.ResponseWriter, r *gemini.Request) {
 		user := User(ctx)
 		if r.URL.RawQuery == "" {
-			w.WriteHeader(10, "Enter a feed URL")
+			w.WriteHeader(30, "/add")
 			return
 		}
 		query, err := url.QueryUnescape(r.URL.RawQuery)
 		if err != nil {
-			w.WriteHeader(10, err.Error()+": Try again")
+			w.WriteHeader(59, err.Error())
 			return
 		}
 		feedURL, err := url.Parse(query)
 		if err != nil {
-			w.WriteHeader(10, err.Error()+": Try again")
+			w.WriteHeader(59, err.Error())
 			return
 		}
 
-		feed, kind, err := feeds.Fetch(ctx, feedURL)
+		// the feed is fetched again, it may have changed since the preview
+		feed, kind, err := feeds.FetchWithManifest(ctx, feedURL)
 		if err != nil {
-			w.WriteHeader(10, err.Error()+": Try again")
+			w.WriteHeader(43, "Failed to fetch the feed: "+err.Error())
 			return
 		}
 
-		if len(feed.Author.Extensions) > 0 {
-			for _, ext := range feed.Author.Extensions {
-				if ext.Rel != "payment" {
-					w.WriteHeader(10, "Author's payment data within feed is malformed")
-					return
-				}
+		if feed.Author == nil || len(feed.Author.Extensions) == 0 {
+			w.WriteHeader(40, "No accepted Payments found within feed")
+			return
+		}
+		for _, ext := range feed.Author.Extensions {
+			if ext.Rel != "payment" {
+				w.WriteHeader(40, "Author's payment data within feed is malformed")
+				return
 			}
-		} else {
-			w.WriteHeader(10, "No accepted Payments found within feed")
+		}
+
+		accepted_payments, err := parseAcceptedPayments(feed.Author)
+		if err != nil {
+			w.WriteHeader(40, err.Error())
+			return
 		}
 
 		conn, err := feeds.ForContext(ctx)
 		if err != nil {
 			panic(err)
 		}
+		defer conn.Close()
 
+		var update *FeedUpdate
 		if err := conn.Raw(func(driverConn interface{}) error {
 			conn := driverConn.(*stdlib.Conn).Conn()
 			tx, err := conn.Begin(ctx)
@@ -171,169 +205,140 @@ func configureRoutes() *gemini.ServeMux {
 					panic(err)
 				}
 			}()
-			rows, err := tx.Query(ctx, `
-			SELECT id, url
+			// a known feed is brought up to date instead
+			var feedID, authorID int
+			if err := tx.QueryRow(ctx, `
+			SELECT id, author_id
 			FROM feeds
-			WHERE url = $1
-		`, feedURL.String())
-			if err != nil {
+			WHERE feed_url = $1
+			ORDER BY id LIMIT 1
+		`, feedURL.String()).Scan(&feedID, &authorID); err != nil && err != pgx.ErrNoRows {
 				panic(err)
 			}
-			var duplicates []*struct {
-				ID  int
-				URL string
-			}
-			for rows.Next() {
-				feed := &struct {
-					ID  int
-					URL string
-				}{}
-				if err := rows.Scan(&feed.ID, &feed.URL); err != nil {
-					panic(err)
-				}
-				log.Println(feed.URL)
-				duplicates = append(duplicates, feed)
-			}
-			if len(duplicates) > 0 {
-				return errors.New("Feed already exists")
-			}
 
 			// TODO Author validate strings
 			if err := func() error {
-				var id int
-				// feed must include an author, insert author first
-				row := tx.QueryRow(ctx, `
-					INSERT INTO authors (
-						name, created, updated, url, email
-					) VALUES (
-						$1,
-						NOW() at time zone 'utc',
-						NOW() at time zone 'utc',
-						$2,
-						$3
-					)
-					RETURNING id;
-				`, feed.Author.Name, feed.Author.URI, feed.Author.Email)
-				if err := row.Scan(&id); err != nil {
-					return err
-				}
-				// TODO at add bitcoin input address validation
-				// TODO viewkey input validation
-				// go doesn't allow arrays of arbitrary length
-				// arbitrarily capping the max accepted payments to 15
-				accepted_payments := make([]*AcceptedPayment, 0, 15)
-				re := regexp.MustCompile(`application\/.+-paymentrequest`)
-				// outer loop finds paymentrequests within the author extensions
-				// if the payment request is not a monero one, then add to accepted_payments array as is
-				// inner loop is to find monero view key within extensions
-				// both view key and address are added together to accepted_payments
-				for _, outer_ext := range feed.Author.Extensions {
-					if re.MatchString(outer_ext.Type) {
-						split_index := strings.Index(outer_ext.Href, ":")
-						address := ""
-						if split_index > -1 {
-							address = outer_ext.Href[split_index+1:]
-						} else {
-							return errors.New("Author's payment data within feed is malformed")
+				if feedID != 0 {
+					var err error
+					update, err = updateFeed(ctx, tx, user.ID, feedID, authorID, feed, accepted_payments)
+					if err != nil {
+						return err
+					}
+				} else {
+					// the author may have feeds listed already, if the
+					// user can prove it
+					authors, err := matchAuthors(ctx, tx, user.ID, accepted_payments)
+					if err != nil {
+						return err
+					}
+
+					if len(authors) == 0 {
+						// feed must include an author, insert author first
+						row := tx.QueryRow(ctx, `
+							INSERT INTO authors (
+								name, created, updated, url, email
+							) VALUES (
+								$1,
+								NOW() at time zone 'utc',
+								NOW() at time zone 'utc',
+								$2,
+								$3
+							)
+							RETURNING id;
+						`, feed.Author.Name, feed.Author.URI, feed.Author.Email)
+						if err := row.Scan(&authorID); err != nil {
+							return err
+						}
+					} else {
+						// every author proven to share the addresses is one
+						// and the same, the best proven one is kept
+						authorID = authors[0]
+						if err := feeds.MergeAuthors(ctx, tx, authorID, authors[1:]); err != nil {
+							return err
 						}
-						if outer_ext.Type == "application/monero-paymentrequest" {
-							re = regexp.MustCompile("4[a-zA-Z\\d]{94}")
-							if re.MatchString(address) {
-								for _, inner_ext := range feed.Author.Extensions {
-									if inner_ext.Type == "application/monero-viewkey" {
-										accepted_payments = append(accepted_payments, &AcceptedPayment{
-											PayType:    outer_ext.Type,
-											ViewKey:    inner_ext.Href,
-											Address:    address,
-											Registered: false,
-										})
-									}
-								}
-							} else {
-								return errors.New("Author's payment data within feed is malformed")
-							}
-						} else {
-							accepted_payments = append(accepted_payments, &AcceptedPayment{
-								PayType:    outer_ext.Type,
-								ViewKey:    "",
-								Address:    outer_ext.Href,
-								Registered: false,
-							})
+						if _, err := tx.Exec(ctx, `
+							UPDATE authors SET
+								name = COALESCE(NULLIF(name, ''), $2),
+								url = COALESCE(NULLIF(url, ''), $3),
+								email = COALESCE(NULLIF(email, ''), $4),
+								updated = NOW() at time zone 'utc'
+							WHERE id = $1;
+						`, authorID, feed.Author.Name, feed.Author.URI, feed.Author.Email); err != nil {
+							return err
 						}
 					}
-				}
-				if len(accepted_payments) < 1 {
-					return errors.New("Failed to process Author's accepted payments")
-				}
-				// add the accepted payments to db table after we found them within the loop
-				for _, pymnt := range accepted_payments {
-					row = tx.QueryRow(ctx, `
-					INSERT INTO accepted_payments (
-						author_id, pay_type, view_key, address, registered, scan_height
-					) VALUES (
-						$1,
-						$2,
-						$3,
-						$4,
-						$5,
-						$6
-					)
-					RETURNING id;
-				`, id, pymnt.PayType, pymnt.ViewKey, pymnt.Address, pymnt.Registered, 0)
-					if err := row.Scan(&id); err != nil {
+
+					_, taken, err := addAcceptedPayments(ctx, tx, authorID, accepted_payments)
+					if err != nil {
 						return err
 					}
-				}
 
-				row = tx.QueryRow(ctx, `
-					INSERT INTO feeds (
-						created, updated, author_id, kind, url,  title, description, approved, feed_url
-					) VALUES (
-						NOW() at time zone 'utc',
-						NOW() at time zone 'utc',
-						$1, $2, $3, $4, $5, $6, $7
-					)
-					ON CONFLICT ON CONSTRAINT feeds_url_key
-					DO UPDATE SET
-						(updated, title, description) =
-						(EXCLUDED.updated, EXCLUDED.title, EXCLUDED.description)
-					RETURNING id;
-				`, id, kind, feed.Link, feed.Title, feed.Description, true, feedURL.String())
-				if err := row.Scan(&id); err != nil {
-					return err
+					row := tx.QueryRow(ctx, `
+						INSERT INTO feeds (
+							created, updated, author_id, kind, url,  title, description, approved, feed_url
+						) VALUES (
+							NOW() at time zone 'utc',
+							NOW() at time zone 'utc',
+							$1, $2, $3, $4, $5, $6, $7
+						)
+						RETURNING id;
+					`, authorID, kind, feed.Link, feed.Title, feed.Description, true, feedURL.String())
+					if err := row.Scan(&feedID); err != nil {
+						return err
+					}
+					if err := feeds.Index(ctx, tx, feed.Items, feedID); err != nil {
+						return err
+					}
+					if len(taken) > 0 {
+						update = &FeedUpdate{FeedID: feedID, Title: feed.Title, URL: feed.Link, New: true}
+						update.addTaken(taken)
+					}
 				}
 
-				if _, err := tx.Exec(ctx, `
+				_, err := tx.Exec(ctx, `
 					INSERT INTO submissions (
 						user_id, feed_id
 					) VALUES ($1, $2)
 					ON CONFLICT ON CONSTRAINT submissions_user_id_feed_id_key
 					DO NOTHING;
-				`, user.ID, id); err != nil {
-					return err
-				}
-
-				return feeds.Index(ctx, tx, feed.Items, id)
+				`, user.ID, feedID)
+				return err
 			}(); err != nil {
 				tx.Rollback(ctx)
 				return err
 			}
 
-			tx.Commit(ctx)
-			return nil
+			return tx.Commit(ctx)
 		}); err != nil {
 			log.Println(err)
-			if err.Error() == "Feed already exists" {
-				w.WriteHeader(10, err.Error())
-			} else {
-				w.WriteHeader(40, "Internal server error")
-			}
+			w.WriteHeader(40, "Internal server error")
 			return
 		}
 
-		w.WriteHeader(30, "/")
+		if update == nil {
+			w.WriteHeader(30, "/")
+			return
+		}
+		w.WriteHeader(20, "text/gemini")
+		err = feedUpdatePage.Execute(w, &FeedUpdatePage{
+			FeedUpdate: update,
+			Logo:       gemmitLogo,
+		})
+		if err != nil {
+			panic(err)
+		}
 	})
 
+	mux.HandleFunc("/lightning/", lightningVote)
+	mux.HandleFunc("/lightning/invoice/", lightningInvoice)
+	mux.HandleFunc("/lightning/preimage/", lightningPreimage)
+
+	mux.HandleFunc("/claim", findFeed)
+	mux.HandleFunc("/claim/", claimFeed)
+	mux.HandleFunc("/viewkey/", registerViewKey)
+	mux.HandleFunc("/manage", manageFeeds)
+	mux.HandleFunc("/manage/", manageFeed)
+
 	mux.HandleFunc("/about", func(ctx context.Context, w gemini.ResponseWriter, r *gemini.Request) {
 		w.WriteHeader(20, "text/gemini")
 		err := aboutPage.Execute(w, &AboutPage{
@@ -347,7 +352,8 @@ func configureRoutes() *gemini.ServeMux {
 	mux.HandleFunc("/earn", func(ctx context.Context, w gemini.ResponseWriter, r *gemini.Request) {
 		w.WriteHeader(20, "text/gemini")
 		err := earnPage.Execute(w, &EarnPage{
-			Logo: gemmitLogo,
+			Logo:   gemmitLogo,
+			Sealed: viewKeyPublic != nil,
 		})
 		if err != nil {
 			panic(err)
@@ -1,4 +1,9 @@
+DROP TABLE prices;
+DROP TABLE feed_claims;
 DROP TABLE submissions;
+DROP TABLE lightning_invoices;
+DROP TABLE rejected_payments;
+DROP TABLE pending_payments;
 DROP TABLE payments;
 DROP TABLE entries;
 DROP TABLE feeds;
@@ -29,9 +34,15 @@ CREATE TABLE accepted_payments (
                                    author_id INTEGER NOT NULL references authors(id),
                                    pay_type varchar NOT NULL,
                                    view_key varchar UNIQUE,
+                                   view_key_checked BOOLEAN NOT NULL DEFAULT false, -- the view key was checked to open the address
                                    address varchar UNIQUE,
                                    registered BOOLEAN NOT NULL,
                                    scan_height INTEGER,
+                                   scanned_block_height bigint, -- how far votes were looked for at the last sync
+                                   blockchain_height bigint,
+                                   synced timestamp,
+                                   retired timestamp, -- removed by the author, no longer scanned but its votes still count
+                                   manual BOOLEAN NOT NULL DEFAULT false, -- added on /manage rather than listed in a feed
                                    UNIQUE (author_id, id)
 );
 
@@ -45,7 +56,8 @@ CREATE TABLE feeds (
                        title varchar,
                        description varchar,
                        approved BOOLEAN NOT NULL,
-                       feed_url varchar UNIQUE
+                       feed_url varchar UNIQUE,
+                       delisted BOOLEAN NOT NULL DEFAULT false -- by its author
 );
 
 CREATE TABLE entries (
@@ -54,6 +66,8 @@ CREATE TABLE entries (
                           published timestamp NOT NULL,
                           url varchar NOT NULL,
                           feed_id INTEGER NOT NULL references feeds(id),
+                          pay_address varchar, -- subaddress or integrated address for votes on this entry alone
+                          hidden BOOLEAN NOT NULL DEFAULT false, -- by the feed's author
                           UNIQUE (url, feed_id)
 );
 
@@ -62,7 +76,47 @@ CREATE TABLE payments (
                                  address varchar NOT NULL,
                                  tx_id varchar NOT NULL,
                                  tx_date timestamp NOT NULL,
-                                 amount decimal NOT NULL,
+                                 amount bigint NOT NULL, -- atomic units of the currency, e.g. piconero
+                                 height INTEGER,
+                                 entry_id INTEGER references entries(id),
+                                 accepted_payments_id INTEGER NOT NULL references accepted_payments(id),
+                                 UNIQUE (accepted_payments_id, tx_id)
+);
+CREATE INDEX payments_tx_date_idx ON payments (tx_date);
+
+CREATE TABLE pending_payments (
+                                 id serial PRIMARY KEY,
+                                 address varchar NOT NULL,
+                                 tx_id varchar NOT NULL,
+                                 tx_date timestamp NOT NULL,
+                                 amount bigint NOT NULL,
+                                 height INTEGER, -- NULL while in the mempool
+                                 entry_id INTEGER references entries(id),
+                                 accepted_payments_id INTEGER NOT NULL references accepted_payments(id),
+                                 UNIQUE (accepted_payments_id, tx_id)
+);
+
+CREATE TABLE rejected_payments (
+                                 id serial PRIMARY KEY,
+                                 address varchar NOT NULL,
+                                 tx_id varchar NOT NULL,
+                                 tx_date timestamp NOT NULL,
+                                 amount bigint NOT NULL,
+                                 reason varchar NOT NULL,
+                                 accepted_payments_id INTEGER NOT NULL references accepted_payments(id),
+                                 UNIQUE (accepted_payments_id, tx_id)
+);
+
+CREATE TABLE lightning_invoices (
+                                 id serial PRIMARY KEY,
+                                 payment_hash varchar NOT NULL UNIQUE,
+                                 invoice varchar NOT NULL,
+                                 amount bigint NOT NULL, -- satoshi
+                                 verify_url varchar NOT NULL, -- LUD-21, empty if the author's server has none
+                                 created timestamp NOT NULL,
+                                 expires timestamp NOT NULL,
+                                 settled timestamp,
+                                 feed_id INTEGER NOT NULL references feeds(id),
                                  accepted_payments_id INTEGER NOT NULL references accepted_payments(id)
 );
 
@@ -72,3 +126,21 @@ CREATE TABLE submissions (
                                feed_id INTEGER NOT NULL references feeds(id),
                                UNIQUE (user_id, feed_id)
 );
+
+CREATE TABLE prices (
+                     id serial PRIMARY KEY,
+                     ticker varchar NOT NULL,
+                     date date NOT NULL,
+                     price numeric NOT NULL, -- one whole coin in the reference currency
+                     UNIQUE (ticker, date)
+);
+
+CREATE TABLE feed_claims (
+                            id serial PRIMARY KEY,
+                            user_id INTEGER NOT NULL references users(id),
+                            feed_id INTEGER NOT NULL references feeds(id),
+                            token varchar NOT NULL UNIQUE,
+                            created timestamp NOT NULL,
+                            verified timestamp, -- NULL until the token was found in the feed
+                            UNIQUE (user_id, feed_id)
+);
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Scoring is how much the value of every single vote adds to the score
+// feeds and posts are ranked by. Anything but a plain sum keeps a single
+// large vote from outweighing many small ones.
+type Scoring struct {
+	Mode string // sum, sqrt, capped or log
+	// Cap is the most a single vote counts in capped mode, in the reference
+	// currency of the prices
+	Cap float64
+}
+
+// scoring is set by the -score and -score-cap flags
+var scoring = &Scoring{Mode: "sum", Cap: 10}
+
+func (s *Scoring) Validate() error {
+	switch s.Mode {
+	case "sum", "sqrt", "log":
+		return nil
+	case "capped":
+		if math.IsNaN(s.Cap) || math.IsInf(s.Cap, 0) || s.Cap <= 0 {
+			return fmt.Errorf("The score cap must be a positive number, not %v", s.Cap)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown scoring mode %q, use sum, sqrt, capped or log", s.Mode)
+}
+
+// Weighted tells if ranking differs from the plain sum of the votes' value
+func (s *Scoring) Weighted() bool {
+	return s.Mode != "sum"
+}
+
+// Label describes the mode next to the score it gives
+func (s *Scoring) Label() string {
+	switch s.Mode {
+	case "sqrt":
+		return "sum of square roots"
+	case "capped":
+		return "at most " + strconv.FormatFloat(s.Cap, 'f', -1, 64) + " per vote"
+	case "log":
+		return "log scaled"
+	}
+	return "sum"
+}
+
+// weight is the SQL weighing the value of a single vote
+func (s *Scoring) weight(value string) string {
+	switch s.Mode {
+	case "sqrt":
+		return "sqrt(" + value + ")"
+	case "capped":
+		return "LEAST(" + value + ", " + strconv.FormatFloat(s.Cap, 'f', -1, 64) + ")"
+	case "log":
+		return "ln(1 + " + value + ")"
+	}
+	return value
+}
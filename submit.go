@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/t-900-a/gemmit/currency"
+	"github.com/t-900-a/gemmit/feeds"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/t-900-a/rss"
+)
+
+// FeedUpdate is what resubmitting a known feed changed, or what adding a new
+// one left out
+type FeedUpdate struct {
+	FeedID  int
+	Title   string
+	URL     string
+	New     bool
+	Changes []string
+}
+
+func (u *FeedUpdate) add(format string, args ...interface{}) {
+	u.Changes = append(u.Changes, fmt.Sprintf(format, args...))
+}
+
+func describePayment(p *AcceptedPayment) string {
+	if c := currency.ForPayType(p.PayType); c != nil {
+		return c.Ticker + " address " + p.Address
+	}
+	return p.Address
+}
+
+// addAcceptedPayments stores the payment methods found in a feed for its
+// author, returning the ones which weren't known yet and the ones another
+// author has
+func addAcceptedPayments(ctx context.Context, tx pgx.Tx, authorID int,
+	accepted []*AcceptedPayment) (added, taken []*AcceptedPayment, err error) {
+	for _, pymnt := range accepted {
+		viewKey, err := sealViewKey(pymnt.ViewKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		// addresses already known stay with the author listing them,
+		// unless that author was matched and merged into this one. View
+		// keys in feeds were checked to open their address when parsed.
+		result, err := tx.Exec(ctx, `
+			INSERT INTO accepted_payments (
+				author_id, pay_type, view_key, view_key_checked, address, registered, scan_height
+			) VALUES (
+				$1,
+				$2,
+				$3,
+				$4,
+				$5,
+				$6,
+				$7
+			)
+			ON CONFLICT DO NOTHING;
+		`, authorID, pymnt.PayType, nullIfEmpty(viewKey), viewKey != "", pymnt.Address, pymnt.Registered, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		if result.RowsAffected() > 0 {
+			added = append(added, pymnt)
+			continue
+		}
+		var other bool
+		if err := tx.QueryRow(ctx, `
+			SELECT EXISTS (
+				SELECT 1 FROM accepted_payments WHERE address = $1 AND author_id <> $2
+			);
+		`, pymnt.Address, authorID).Scan(&other); err != nil {
+			return nil, nil, err
+		}
+		if other {
+			taken = append(taken, pymnt)
+		}
+	}
+	return added, taken, nil
+}
+
+// addTaken tells the submitter about the addresses another author has
+func (u *FeedUpdate) addTaken(taken []*AcceptedPayment) {
+	for _, p := range taken {
+		u.add("%s belongs to another author, it wasn't added", describePayment(p))
+	}
+}
+
+// matchAuthors finds the authors the user proved to be among the ones listing
+// the accepted payments, see feeds.MatchAuthors. A view key in the feed was
+// checked to open its address when it was parsed.
+func matchAuthors(ctx context.Context, tx pgx.Tx, userID int,
+	accepted []*AcceptedPayment) ([]int, error) {
+	addresses := make([]string, 0, len(accepted))
+	var opened []string
+	for _, pymnt := range accepted {
+		addresses = append(addresses, pymnt.Address)
+		if pymnt.ViewKey != "" {
+			opened = append(opened, pymnt.Address)
+		}
+	}
+	return feeds.MatchAuthors(ctx, tx, userID, addresses, opened)
+}
+
+// hasOpened tells if a view key in the feed opens one of its addresses
+func hasOpened(accepted []*AcceptedPayment) bool {
+	for _, pymnt := range accepted {
+		if pymnt.ViewKey != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// updateFeed syncs a known feed with what was just fetched from it, on
+// behalf of the user resubmitting it
+func updateFeed(ctx context.Context, tx pgx.Tx, userID, feedID, authorID int,
+	feed *rss.Feed, accepted []*AcceptedPayment) (*FeedUpdate, error) {
+	u := &FeedUpdate{FeedID: feedID, Title: feed.Title, URL: feed.Link}
+
+	var title, description, link string
+	if err := tx.QueryRow(ctx, `
+		SELECT COALESCE(title, ''), COALESCE(description, ''), COALESCE(url, '')
+		FROM feeds WHERE id = $1;
+	`, feedID).Scan(&title, &description, &link); err != nil {
+		return nil, err
+	}
+	if title != feed.Title {
+		u.add("Title changed from %q to %q", title, feed.Title)
+	}
+	if description != feed.Description {
+		u.add("Description changed")
+	}
+	if link != feed.Link {
+		u.add("Link changed from %s to %s", link, feed.Link)
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE feeds SET
+			title = $2, description = $3, url = $4,
+			updated = NOW() at time zone 'utc'
+		WHERE id = $1;
+	`, feedID, feed.Title, feed.Description, feed.Link); err != nil {
+		return nil, err
+	}
+
+	authors, err := matchAuthors(ctx, tx, userID, accepted)
+	if err != nil {
+		return nil, err
+	}
+	var others []int
+	for _, id := range authors {
+		if id != authorID {
+			others = append(others, id)
+		}
+	}
+	if len(others) > 0 {
+		// the feed's own author takes the others in only if it's proven
+		// too, by the user's claim to the feed or a view key in it
+		proven := hasOpened(accepted)
+		if !proven {
+			if err := tx.QueryRow(ctx, `
+				SELECT EXISTS (
+					SELECT 1 FROM feed_claims
+					WHERE feed_id = $1 AND user_id = $2 AND verified IS NOT NULL
+				);
+			`, feedID, userID).Scan(&proven); err != nil {
+				return nil, err
+			}
+		}
+		if proven {
+			if err := feeds.MergeAuthors(ctx, tx, authorID, others); err != nil {
+				return nil, err
+			}
+			u.add("Merged with %d other authors sharing its payment addresses", len(others))
+		}
+	}
+
+	added, taken, err := addAcceptedPayments(ctx, tx, authorID, accepted)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range added {
+		u.add("Added %s", describePayment(p))
+	}
+	u.addTaken(taken)
+	if err := syncRetired(ctx, tx, u, feedID, authorID, accepted); err != nil {
+		return nil, err
+	}
+	if err := syncRestored(ctx, tx, u, userID, authorID, accepted); err != nil {
+		return nil, err
+	}
+	for _, pymnt := range accepted {
+		if pymnt.ViewKey == "" {
+			continue
+		}
+		viewKey, err := sealViewKey(pymnt.ViewKey)
+		if err != nil {
+			return nil, err
+		}
+		result, err := tx.Exec(ctx, `
+			UPDATE accepted_payments SET view_key = $3, view_key_checked = true, registered = false
+			WHERE author_id = $1 AND address = $2 AND view_key IS NULL;
+		`, authorID, pymnt.Address, viewKey)
+		if err != nil {
+			return nil, err
+		}
+		if result.RowsAffected() > 0 {
+			u.add("Registered the view key of %s", describePayment(pymnt))
+		}
+	}
+
+	var before, after int
+	if err := tx.QueryRow(ctx, `
+		SELECT count(*) FROM entries WHERE feed_id = $1;
+	`, feedID).Scan(&before); err != nil {
+		return nil, err
+	}
+	if err := feeds.Index(ctx, tx, feed.Items, feedID); err != nil {
+		return nil, err
+	}
+	if err := tx.QueryRow(ctx, `
+		SELECT count(*) FROM entries WHERE feed_id = $1;
+	`, feedID).Scan(&after); err != nil {
+		return nil, err
+	}
+	if after > before {
+		u.add("%d new entries", after-before)
+	}
+	return u, nil
+}
+
+// syncRetired retires the payment methods the feed no longer lists, they can
+// be restored on /manage. Payment methods added on /manage aren't in the
+// feed, they are left alone, and so is everything while the author has other
+// feeds, which may still list them.
+func syncRetired(ctx context.Context, tx pgx.Tx, u *FeedUpdate, feedID, authorID int,
+	accepted []*AcceptedPayment) error {
+	addresses := make([]string, 0, len(accepted))
+	for _, pymnt := range accepted {
+		addresses = append(addresses, pymnt.Address)
+	}
+	var others bool
+	if err := tx.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM feeds WHERE author_id = $1 AND id <> $2);
+	`, authorID, feedID).Scan(&others); err != nil {
+		return err
+	}
+	if others {
+		removed, err := queryPayments(ctx, tx, `
+			SELECT pay_type, address FROM accepted_payments
+			WHERE author_id = $1 AND NOT (address = ANY($2))
+				AND retired IS NULL AND NOT manual
+			ORDER BY id;
+		`, authorID, addresses)
+		if err != nil {
+			return err
+		}
+		for _, p := range removed {
+			u.add("%s is no longer in the feed, it's kept for the author's other feeds", describePayment(p))
+		}
+		return nil
+	}
+	retired, err := queryPayments(ctx, tx, `
+		UPDATE accepted_payments SET retired = NOW() at time zone 'utc'
+		WHERE author_id = $1 AND NOT (address = ANY($2))
+			AND retired IS NULL AND NOT manual
+		RETURNING pay_type, address;
+	`, authorID, addresses)
+	if err != nil {
+		return err
+	}
+	for _, p := range retired {
+		u.add("Retired %s, it's no longer in the feed, votes already received keep counting", describePayment(p))
+	}
+	return nil
+}
+
+// syncRestored brings back the retired payment methods the feed lists again.
+// They may have been retired on /manage, so only a user who claimed every
+// feed of the author restores them by resubmitting, anyone else is told
+// they stay retired.
+func syncRestored(ctx context.Context, tx pgx.Tx, u *FeedUpdate, userID, authorID int,
+	accepted []*AcceptedPayment) error {
+	addresses := make([]string, 0, len(accepted))
+	for _, pymnt := range accepted {
+		addresses = append(addresses, pymnt.Address)
+	}
+	var owns bool
+	if err := tx.QueryRow(ctx, `
+		SELECT NOT EXISTS (
+			SELECT 1 FROM feeds f
+			WHERE f.author_id = $1 AND NOT EXISTS (
+				SELECT 1 FROM feed_claims c
+				WHERE c.feed_id = f.id AND c.user_id = $2
+					AND c.verified IS NOT NULL
+			)
+		);
+	`, authorID, userID).Scan(&owns); err != nil {
+		return err
+	}
+	if !owns {
+		retired, err := queryPayments(ctx, tx, `
+			SELECT pay_type, address FROM accepted_payments
+			WHERE author_id = $1 AND address = ANY($2) AND retired IS NOT NULL
+			ORDER BY id;
+		`, authorID, addresses)
+		if err != nil {
+			return err
+		}
+		for _, p := range retired {
+			u.add("%s is in the feed again but stays retired, the author can restore it on /manage", describePayment(p))
+		}
+		return nil
+	}
+	restored, err := queryPayments(ctx, tx, `
+		UPDATE accepted_payments SET retired = NULL
+		WHERE author_id = $1 AND address = ANY($2) AND retired IS NOT NULL
+		RETURNING pay_type, address;
+	`, authorID, addresses)
+	if err != nil {
+		return err
+	}
+	for _, p := range restored {
+		u.add("Restored %s, it's in the feed again", describePayment(p))
+	}
+	return nil
+}
+
+// queryPayments runs a query returning the pay_type and address of accepted
+// payments
+func queryPayments(ctx context.Context, tx pgx.Tx, query string, args ...interface{}) ([]*AcceptedPayment, error) {
+	rows, err := tx.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var payments []*AcceptedPayment
+	for rows.Next() {
+		p := &AcceptedPayment{}
+		if err := rows.Scan(&p.PayType, &p.Address); err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
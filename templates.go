@@ -3,6 +3,9 @@ package main
 import (
 	"text/template"
 	"time"
+
+	"github.com/t-900-a/gemmit/cryptonote"
+	"github.com/t-900-a/gemmit/votes"
 )
 
 type Entry struct {
@@ -10,18 +13,24 @@ type Entry struct {
 	URL       string
 	Published time.Time
 	Feed      string
-	VoteCnt   int
-	VoteAmt   string
+	ID        int
+	AuthorID  int
+	Votes     *Votes
+	// votes paid to the entry's own address, also part of the feed's votes
+	EntryVotes *Votes
 }
 
 type Feed struct {
+	ID          int
 	Title       string
 	Description string
 	URL         string
 	Author      string
 	Updated     time.Time
-	VoteCnt     int
-	VoteAmt     string
+	AuthorID    int
+	Votes       *Votes
+	Syncs       []*SyncStatus
+	Lightning   bool // the author accepts Lightning votes
 }
 
 type Author struct {
@@ -31,8 +40,29 @@ type Author struct {
 	Email string
 }
 
+// votesTemplate lists votes per currency, they are only compared through
+// the score
+const votesTemplate = `{{define "votes" -}}
+Votes: {{.Count}}{{range .Totals}} | {{.}}{{end}}{{if .Score}} | Score: {{.Score}}{{if .Partial}} (partial, {{.Unpriced}} votes without a price left out){{end}}{{end}}
+{{- if .Weighted}} | Ranked by {{.Weighted}} ({{.Scoring.Label}}){{end}}
+{{- if .PendingCount}} | {{.PendingCount}} unconfirmed{{range .Pending}}, {{.}}{{end}}{{end}}
+{{- end}}`
+
+// pagesTemplate links the pages around a page of a list
+const pagesTemplate = `{{define "pages" -}}
+{{if .Previous}}=> {{.Path}}?{{.Previous}} Previous page
+{{end -}}
+{{if .Next}}=> {{.Path}}?{{.Next}} Next page
+{{end -}}
+{{if .First}}=> {{.Path}} First page
+{{end -}}
+{{- end}}`
+
 type DashboardPage struct {
+	*Ranking
 	Feeds   []*Feed
+	Page    *Page
+	Entries []*Entry
 	Logo    string
 	Newline string
 }
@@ -44,19 +74,41 @@ var dashboardPage = template.Must(template.
 			return date.Format("Monday, January 2 2006")
 		},
 	}).
-	Parse(`{{.Logo}}
+	Parse(votesTemplate + pagesTemplate + `{{.Logo}}
 
 => /about About Gemmit: the front page of gemini
 => /add Add a new feed
 => /earn How to earn
 => /vote How to vote
+=> /manage Manage your feeds
+
+=> /hot Hot
+=> /top Top of all time
+=> /top/day Top of the day
+=> /top/week Top of the week
+=> /top/month Top of the month
+=> /top/year Top of the year
 {{.Newline}}
 {{- if .Feeds }}
-## Top 10 Feeds of all time
+## {{.Title}}
+{{.Page.Total}} feeds are listed
 {{range .Feeds}}
 => {{.URL}} {{.Title}} - {{.Description}}
-Votes: {{.VoteCnt}} | ɱ  {{.VoteAmt}}
+{{template "votes" .Votes}}
+{{range .Syncs}}{{.Currency.Ticker}} votes synced to block {{.Scanned}} ({{.Percent}}% caught up)
+{{end -}}
 Last updated by {{.Author}} on {{.Updated | date}}
+{{if .Lightning}}=> /lightning/{{.ID}} ⚡ Vote with Lightning
+{{end -}}
+{{end}}
+{{end}}
+{{- template "pages" .Page}}
+{{- if .Entries}}
+## {{.EntriesTitle}}
+{{range .Entries}}
+=> {{.URL}} {{.Title}}
+{{template "votes" .EntryVotes}}
+Published on {{.Published | date}} within the {{.Feed}} feed
 {{end}}
 {{end}}
 
@@ -66,6 +118,7 @@ Last updated by {{.Author}} on {{.Updated | date}}
 
 type BrowsePage struct {
 	Entries []*Entry
+	Page    *Page
 	Logo    string
 	Newline string
 }
@@ -77,16 +130,20 @@ var browsePage = template.Must(template.
 			return date.Format("Monday, January 2 2006")
 		},
 	}).
-	Parse(`{{.Logo}}
+	Parse(votesTemplate + pagesTemplate + `{{.Logo}}
 {{.Newline}}
 {{- if .Entries }}
 ## Latest Posts
+{{.Page.Total}} posts in all
 {{range .Entries}}
 => {{.URL}} {{.Title}}
-Feed Votes: {{.VoteCnt}} | ɱ  {{.VoteAmt}}
+{{if .EntryVotes.Count}}{{template "votes" .EntryVotes}}
+{{end -}}
+Feed {{template "votes" .Votes}}
 Published on {{.Published | date}} within the {{.Feed}} feed
 {{end}}
 {{end}}
+{{- template "pages" .Page}}
 
 
 => / Back
@@ -104,7 +161,8 @@ Gemmit is a social news aggregation and web content rating website for the gemin
 
 Gemmit seeks not to build a walled garden, but to leverage existing web protocols that respect security through decentralization and privacy.
 
-Feeds are ranked via votes published on Monero.
+Feeds are ranked via votes published on Monero and other blockchains. Votes in different currencies are compared by their value on the day they were paid.
+The front page shows the hot feeds: recent votes weigh more than old ones, and feeds that keep publishing stay up. The top feeds of all time are on /top.
 Votes for the sake of gemmit are defined as: any incoming transaction to a blockchain address that has been associated with an atom feeds or entries respective author(s)
 
 This approach has several benefits.
@@ -123,7 +181,8 @@ This approach has several benefits.
 `))
 
 type EarnPage struct {
-	Logo string
+	Logo   string
+	Sealed bool
 }
 
 var earnPage = template.Must(template.
@@ -138,13 +197,14 @@ As a feed author your subscribers will reward you with micropayments that will i
 => https://mymonero.com/ Monero Wallet
 # Add your payment address to your atom feed (as a subelement of author)
 > <atom:link rel="payment" type="application/monero-paymentrequest" href="monero:donate.getmonero.org"/>
-# Add your secret view key to your atom feed (as a subelement of author)
->   ...
-> 	<author>
-> 		<name>anon</name>
-> 		<content type="application/monero-viewkey">ba98e9501f1f5bc930e7c9fedb2424d17650da85936fb78b7d95ef1f3e306d02</content>
-> 	</author>
-> 	...
+# Monero forks work the same way, e.g. Wownero
+> <atom:link rel="payment" type="application/wownero-paymentrequest" href="wownero:Wo3MWeKwtA918DU4c69hVSNgejdWFCRCuWjShRY66mJkU2Hv58eygJWDJS1MNa2Ge5M1WjUkGHuLqHkweDxwZZU42d16v94mP"/>
+# Or add a Lightning address or LNURL-pay link, voters get invoices from your Lightning server
+> <atom:link rel="payment" type="application/lightning-paymentrequest" href="lightning:you@your-wallet.example"/>
+# Publishing a gemtext feed instead? Link your payment addresses from the feed page
+> => monero:44AFFq5kSiGBoZ4NMDwYtN18obc8AemS33DBLWs3H7otXft3XjrpDtQGv7SqSsaBYBb98uNbr2VBBEt7f2wfn3RVGQBEP3A Vote with Monero
+> => lightning:you@your-wallet.example Vote with Lightning
+Or once for all the feeds of a directory, from .well-known/gemmit next to them, a gemtext page with the same links and your name as its heading. gemini://your.capsule/.well-known/gemmit covers every feed of the capsule without one.
 # Request donations within the content that you produce
 => http://asciiqr.com/ Generate ASCII QR Code Online
 => https://github.com/fumiyas/qrc Or locally
@@ -162,8 +222,20 @@ As a feed author your subscribers will reward you with micropayments that will i
 █ ▀▀▀ █ ██▀▄▀▀█▄▄█▄▀▄▄▀ █
 ▀▀▀▀▀▀▀ ▀▀ ▀▀▀    ▀ ▀ ▀▀▀
 => monero:donate.getmonero.org Donate for more great content
+# Optionally, let readers vote for a single entry
+Give the entry its own integrated address or subaddress of the same wallet, and votes paid to it are shown with the entry as well as counted for your feed.
+> 	<entry>
+> 		...
+> 		<link rel="enclosure" type="application/monero-paymentrequest" href="monero:4H1R4BjWQDCJsEgekjMnABU4TBzc2Dt29EPAvkRxbANsAnjyPbb3iQ1YBRk1UXcdRsiKc9dhwMVgN5S9cQUiyoogKZst2aTHXL221mGfcg"/>
+> 	</entry>
 # Lastly, add your feed to Gemmit
 => /add Add feed
+You'll see what Gemmit found in it before it's added. Adding it again later fetches it right away and shows what changed, new payment links included.
+# Then register your secret view key privately
+Gemmit needs the view key of your address to see the votes you receive. Keep it out of your feed, anyone could read every payment to you there.
+Claim your feed with a client certificate, you get a token to put into your feed for a moment to prove it's yours. Once it's found you can enter the view key{{if .Sealed}}, it is stored encrypted{{end}}.
+=> /claim Claim your feed
+Your claimed feeds can be managed from then on: add or retire payment methods, hide entries or delist the feed.
 
 => https://github.com/t-900-a/awesome-gemmit/ As the ecosystem grows scripts to automate feed generation will become available
 
@@ -184,6 +256,8 @@ Subscribe to any feed on the site, if you enjoy the feeds content please vote/ti
 
 Their address should be displayed within in their content as a QR Code or a link. After tipping your vote will be reflected on this site.
 
+Feeds whose authors accept Lightning show a "Vote with Lightning" link, pay the invoice with any Lightning wallet to tip the author. Only the author's own server can tell the invoice was paid, so Lightning votes aren't counted in the rankings.
+
 Feeds can be subscribed to via a dedicated feed reader, but most Gemini Browsers include functionality to subscribe to feeds.
 
 => https://github.com/t-900-a/awesome-gemmit/#readers More information on readers
@@ -196,6 +270,290 @@ Feeds can be subscribed to via a dedicated feed reader, but most Gemini Browsers
 => / Back to the Feeds
 `))
 
+type LightningInvoicePage struct {
+	*votes.Invoice
+	Expired bool
+	Logo    string
+}
+
+var lightningInvoicePage = template.Must(template.
+	New("lightningInvoice").
+	Funcs(template.FuncMap{
+		"time": func(date time.Time) string {
+			return date.Format("Monday, January 2 2006 15:04 MST")
+		},
+	}).
+	Parse(`{{.Logo}}
+
+## Lightning vote for {{.Feed}}
+{{if .Settled}}
+Paid, thank you! Your vote of {{.Amount}} sats was reported by the author's own Lightning server, which Gemmit can't verify, so it isn't counted in the rankings.
+{{else if .Expired}}
+This invoice expired unpaid.
+=> /lightning/{{.FeedID}} Request a new invoice
+{{else}}
+Pay {{.Amount}} sats with any Lightning wallet before {{.Expires | time}}.
+=> lightning:{{.PR}} Pay with Lightning
+` + "```" + `
+{{.PR}}
+` + "```" + `
+=> /lightning/invoice/{{.PaymentHash}} Check payment
+{{- if not .Verify}}
+The author's Lightning server doesn't report payments, your wallet shows a preimage (proof of payment) once paid.
+=> /lightning/preimage/{{.PaymentHash}} Enter the preimage
+{{- end}}
+{{end}}
+=> / Back to the Feeds
+`))
+
+type ClaimPage struct {
+	*Claim
+	Logo string
+}
+
+var claimPage = template.Must(template.
+	New("claim").
+	Parse(`{{.Logo}}
+
+## Claim {{.FeedTitle}}
+{{if .Verified}}
+Your client certificate is now known as the author of this feed, the token can be removed from the feed again.
+
+=> /manage/{{.FeedID}} Manage the feed
+=> /viewkey/{{.FeedID}} Register a private view key
+{{if .Revoked}}
+Revoked {{.Revoked}} claims of other certificates.
+{{else}}
+Other certificates may have claimed the feed as well, e.g. of a previous owner. Put the token into the feed again to revoke their claims:
+
+` + "```" + `
+{{.Token}}
+` + "```" + `
+
+=> /claim/{{.FeedID}}/revoke-others The token is published, revoke the other claims
+{{- end}}
+=> /claim/{{.FeedID}}/revoke Revoke your own claim
+{{else}}
+Prove that you are the author of this feed by putting this token anywhere into it. In an Atom feed as an extension of the feed:
+
+` + "```" + `
+<atom:link rel="gemmit-claim" href="{{.Token}}"/>
+` + "```" + `
+
+In a gemtext feed as a line of its own:
+
+` + "```" + `
+{{.Token}}
+` + "```" + `
+
+The claim is bound to the client certificate you are using, keep using it.
+
+=> /claim/{{.FeedID}}/verify The token is published, check my feed
+{{end}}
+=> / Back to the Feeds
+`))
+
+type ViewKeyPage struct {
+	*Claim
+	Account *AcceptedPayment
+	Logo    string
+	Sealed  bool
+}
+
+var viewKeyPage = template.Must(template.
+	New("viewKey").
+	Parse(`{{.Logo}}
+
+## View key registered for {{.FeedTitle}}
+
+Votes to {{.Account.Address}} will be counted from the next scan on. The view key is {{if .Sealed}}stored encrypted and {{end}}never shown, it can be removed from your feed.
+
+=> / Back to the Feeds
+`))
+
+type ManagePage struct {
+	Feeds []*ManagedFeed
+	Logo  string
+}
+
+var managePage = template.Must(template.
+	New("manage").
+	Parse(`{{.Logo}}
+
+## Your feeds
+{{range .Feeds}}
+=> /manage/{{.ID}} {{.Title}}{{if .Delisted}} (delisted){{end}}
+{{- else}}
+You haven't claimed a feed with this client certificate yet.
+{{- end}}
+
+=> /claim Claim a feed
+=> / Back to the Feeds
+`))
+
+type ManageFeedPage struct {
+	*ManagedFeed
+	Logo string
+}
+
+var manageFeedPage = template.Must(template.
+	New("manageFeed").
+	Parse(`{{.Logo}}
+
+## Manage {{.Title}}
+=> {{.URL}} {{.URL}}
+{{if .Delisted}}
+This feed is delisted, it isn't shown on Gemmit.
+=> /manage/{{.ID}}/relist List it again
+{{- else}}
+=> /manage/{{.ID}}/delist Delist this feed
+{{- end}}
+=> /manage/{{.ID}}/entries Hide or show entries
+
+### Payment methods
+{{- if not .OwnsAuthor}}
+These belong to the feed's author, who has other feeds you haven't claimed. Claim all of them to change the payment methods.
+{{- end}}
+{{range .Payments}}
+{{if .Currency}}{{.Currency.Symbol}} {{end}}{{.Address}}{{if .Retired}} (retired){{end}}
+{{- if $.OwnsAuthor}}
+{{if .Retired -}}
+=> /manage/{{$.ID}}/restore/{{.ID}} Accept votes again
+{{- else -}}
+=> /manage/{{$.ID}}/retire/{{.ID}} Retire, votes already received keep counting
+{{- if .NeedsViewKey}}
+=> /viewkey/{{$.ID}} Register the view key, votes can't be seen without it
+{{- end}}
+{{- end}}
+{{- end}}
+{{end}}
+{{- if .OwnsAuthor}}
+=> /manage/{{.ID}}/payment Add a payment method
+{{end}}
+=> /claim/{{.ID}} Your claim
+
+=> /manage Your feeds
+`))
+
+var manageEntriesPage = template.Must(template.
+	New("manageEntries").
+	Funcs(template.FuncMap{
+		"date": func(date time.Time) string {
+			return date.Format("Monday, January 2 2006")
+		},
+	}).
+	Parse(`{{.Logo}}
+
+## Entries of {{.Title}}
+Hidden entries aren't listed, votes for them still count for the feed.
+{{range .Entries}}
+=> {{.URL}} {{.Title}}
+Published on {{.Published | date}}
+{{if .Hidden -}}
+=> /manage/{{$.ID}}/show/{{.ID}} Hidden, show it again
+{{- else -}}
+=> /manage/{{$.ID}}/hide/{{.ID}} Hide
+{{- end}}
+{{end}}
+=> /manage/{{.ID}} Back
+`))
+
+type FeedPreviewPage struct {
+	*FeedPreview
+	Logo string
+}
+
+var feedPreviewPage = template.Must(template.
+	New("feedPreview").
+	Funcs(template.FuncMap{
+		"date": func(date time.Time) string {
+			return date.Format("Monday, January 2 2006")
+		},
+		"payment": describePayment,
+		"needsViewKey": func(p *AcceptedPayment) bool {
+			return p.ViewKey == "" && cryptonote.CoinForPayType(p.PayType) != nil
+		},
+	}).
+	Parse(`{{.Logo}}
+
+## {{if .Feed.Title}}{{.Feed.Title}}{{else}}Untitled feed{{end}}
+=> {{.FeedURL}} {{.FeedURL}}
+{{if .Feed.Description}}> {{.Feed.Description}}
+{{end -}}
+{{if .Known}}
+This feed is listed already, adding it again updates it.
+{{end}}
+### Author
+{{with .Author -}}
+{{if .Name}}{{.Name}}{{else}}No name{{end}}
+{{- if .Email}}
+Email: {{.Email}}
+{{- end}}
+{{- if .URI}}
+=> {{.URI}} {{.URI}}
+{{- end}}
+{{- else -}}
+None
+{{- end}}
+
+### Payment methods
+{{range .Payments}}
+{{- if .Payment -}}
+✓ {{payment .Payment}}{{if .Payment.ViewKey}}, with its view key{{else if needsViewKey .Payment}}, register its view key once the feed is added{{end}}
+{{else if .Ignored -}}
+- Ignored {{.Href}}: {{.Problem}}
+{{else -}}
+✗ {{.Href}}: {{.Problem}}
+{{end -}}
+{{else -}}
+None found
+{{end}}
+### Latest entries
+{{range .Entries}}
+=> {{.Link}} {{if .Title}}{{.Title}}{{else}}Untitled{{end}}
+{{if .Date.IsZero}}No publication date{{else}}Published on {{.Date | date}}{{end}}
+{{else}}
+No entries found
+{{end -}}
+{{if .More}}
+and {{.More}} more
+{{end}}
+{{- if .CanAdd}}
+=> /add/confirm?{{.Confirm}} {{if .Known}}Update the feed{{else}}Add the feed{{end}}
+{{- else}}
+### The feed can't be added yet
+{{range .Problems}}
+* {{.}}
+{{- end}}
+{{- end}}
+
+=> /add Check another feed
+=> / Back to the Feeds
+`))
+
+type FeedUpdatePage struct {
+	*FeedUpdate
+	Logo string
+}
+
+var feedUpdatePage = template.Must(template.
+	New("feedUpdate").
+	Parse(`{{.Logo}}
+
+## {{.Title}} {{if .New}}was added{{else}}is up to date{{end}}
+=> {{.URL}} {{.URL}}
+
+{{if .New}}The feed was added, but not all of it.{{else}}The feed was known already and was just fetched again.{{end}}
+{{range .Changes}}
+* {{.}}
+{{- else}}
+Nothing changed since it was last fetched.
+{{- end}}
+
+=> /claim/{{.FeedID}} Manage the feed after claiming it
+=> / Back to the Feeds
+`))
+
 var gemmitLogo = "```\u0020.\u0020\u0020\u0020\u0020\u0020'\u0020\u0020\u0020\u0020,\n\u0020\u0020__G͟E͟M͟M͟I͟T͟__\n_\u0020/_|_____|_\\\u0020_\n\u0020\u0020'.\u0020\\\u0020\u0020\u0020/\u0020.'\n\u0020\u0020\u0020\u0020'.\\\u0020/.'\n\u0020\u0020\u0020\u0020\u0020\u0020'.'\n```"
 
 type AcceptedPayment struct {
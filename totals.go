@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/t-900-a/gemmit/currency"
+)
+
+// VoteTotal is what was voted in one currency, amounts of different
+// currencies are never added up
+type VoteTotal struct {
+	Currency *currency.Currency
+	Count    int
+	Amount   string // atomic units
+}
+
+func (t *VoteTotal) String() string {
+	return t.Currency.Symbol + " " + t.Currency.FormatString(t.Amount)
+}
+
+// Votes are the votes of an author or entry grouped per currency. The score
+// is their value at the price of the day each vote was paid, it is empty
+// until prices are imported. Weighted is the score ranked by, when the
+// scoring mode isn't a plain sum. Votes in currencies without any price
+// are left out of both, Unpriced counts them.
+type Votes struct {
+	Count        int
+	Totals       []*VoteTotal
+	Score        string
+	Weighted     string
+	Scoring      *Scoring
+	Unpriced     int
+	PendingCount int
+	Pending      []*VoteTotal
+}
+
+// Partial tells if the score leaves out votes without a price
+func (v *Votes) Partial() bool {
+	return v.Score != "" && v.Unpriced > 0
+}
+
+// currencyArgs are the currencies as arrays, $1 to $3 of valuedPayments
+func currencyArgs() []interface{} {
+	var (
+		payTypes []string
+		tickers  []string
+		decimals []int32
+	)
+	for _, c := range currency.Currencies {
+		payTypes = append(payTypes, c.PayType)
+		tickers = append(tickers, c.Ticker)
+		decimals = append(decimals, int32(c.Decimals))
+	}
+	return []interface{}{payTypes, tickers, decimals}
+}
+
+// valuedPayments selects the payments in table along with their ticker and
+// their value at the rate of the day they were paid, or the nearest rate
+// there is, weighted by the scoring mode. Payment types with the same
+// ticker, like on-chain bitcoin and Lightning, are the same currency.
+// Payments of types gemmit doesn't know any more are still counted, with a
+// NULL ticker and score, and so are those of currencies without any price,
+// with a NULL score. They are left out of the scores.
+func valuedPayments(table string) string {
+	return `
+		SELECT p.amount, p.entry_id, p.tx_date, ap.author_id, c.ticker,
+			p.amount * pr.price / 10::numeric ^ c.decimals AS score,
+			` + scoring.weight("(p.amount * pr.price / 10::numeric ^ c.decimals)") + ` AS weighted
+		FROM ` + table + ` p
+		INNER JOIN accepted_payments ap ON p.accepted_payments_id = ap.id
+		LEFT JOIN unnest($1::varchar[], $2::varchar[], $3::int[])
+			AS c(pay_type, ticker, decimals) ON c.pay_type = ap.pay_type
+		LEFT JOIN LATERAL (
+			SELECT price FROM prices
+			WHERE prices.ticker = c.ticker
+			ORDER BY prices.date > p.tx_date::date, abs(prices.date - p.tx_date::date)
+			LIMIT 1
+		) pr ON true`
+}
+
+// loadVotes sums up the votes per currency of the authors or entries in
+// ids, key being author_id or entry_id. Only votes paid since then count,
+// all of them if since is zero.
+func loadVotes(ctx context.Context, tx *sql.Tx, key string, ids []int, since time.Time) (map[int]*Votes, error) {
+	votes := make(map[int]*Votes, len(ids))
+	for _, id := range ids {
+		votes[id] = &Votes{Scoring: scoring}
+	}
+	ids32 := make([]int32, 0, len(ids))
+	for _, id := range ids {
+		ids32 = append(ids32, int32(id))
+	}
+
+	for _, table := range []string{"payments", "pending_payments"} {
+		// the score adds up all currencies, it is summed up as numeric
+		// along with the totals of each of them
+		rows, err := tx.QueryContext(ctx, fmt.Sprintf(`
+			SELECT v.%[1]s, v.ticker, count(*), sum(v.amount),
+				round(sum(sum(v.score)) OVER w, 2)::text,
+				round(sum(sum(v.weighted)) OVER w, 2)::text,
+				count(*) FILTER (WHERE v.score IS NULL),
+				min(v.tx_date::date) FILTER (WHERE v.score IS NULL)::text,
+				max(v.tx_date::date) FILTER (WHERE v.score IS NULL)::text
+			FROM (%[2]s) v
+			WHERE v.%[1]s = ANY($4) AND v.tx_date >= $5
+			GROUP BY v.%[1]s, v.ticker
+			WINDOW w AS (PARTITION BY v.%[1]s)
+			ORDER BY v.ticker;
+		`, key, valuedPayments(table)), append(currencyArgs(), ids32, since)...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var (
+				id       int
+				ticker   sql.NullString
+				total    VoteTotal
+				score    sql.NullString
+				weighted sql.NullString
+				unpriced int
+				from, to sql.NullString
+			)
+			if err := rows.Scan(&id, &ticker, &total.Count, &total.Amount, &score, &weighted,
+				&unpriced, &from, &to); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			v := votes[id]
+			total.Currency = currencyForTicker(ticker.String)
+			if table == "pending_payments" {
+				v.PendingCount += total.Count
+				if total.Currency != nil {
+					v.Pending = append(v.Pending, &total)
+				}
+				continue
+			}
+			v.Count += total.Count
+			if total.Currency != nil {
+				v.Totals = append(v.Totals, &total)
+			}
+			if unpriced > 0 {
+				v.Unpriced += unpriced
+				logUnpriced(ticker, from.String, to.String)
+			}
+			v.Score = score.String
+			if scoring.Weighted() {
+				v.Weighted = weighted.String
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return votes, nil
+}
+
+// unpricedLogged holds the tickers already logged as missing prices, the
+// votes are loaded on every page
+var unpricedLogged sync.Map
+
+// logUnpriced tells the administrator votes were left out of the scores
+// for lack of prices, once per currency
+func logUnpriced(ticker sql.NullString, from, to string) {
+	name := ticker.String
+	if !ticker.Valid {
+		name = "payment types no longer known"
+	}
+	if _, logged := unpricedLogged.LoadOrStore(name, true); logged {
+		return
+	}
+	log.Printf("No price for %s, votes paid from %s to %s are left out of the scores", name, from, to)
+}
+
+func currencyForTicker(ticker string) *currency.Currency {
+	for _, c := range currency.Currencies {
+		if c.Ticker == ticker {
+			return c
+		}
+	}
+	return nil
+}
+
+// SyncStatus is how far the votes to one of an author's accounts were
+// looked for
+type SyncStatus struct {
+	Currency    *currency.Currency
+	Scanned     uint64
+	ChainHeight uint64
+	Synced      time.Time
+}
+
+// Percent is how much of the chain was scanned, rounded down so that an
+// account is only caught up once it really is
+func (s *SyncStatus) Percent() uint64 {
+	if s.ChainHeight == 0 || s.Scanned >= s.ChainHeight {
+		return 100
+	}
+	return s.Scanned * 100 / s.ChainHeight
+}
+
+// loadSyncs looks up the sync status of the authors' accounts, those
+// without a chain to scan like Lightning have none
+func loadSyncs(ctx context.Context, tx *sql.Tx, authors []int) (map[int][]*SyncStatus, error) {
+	ids := make([]int32, 0, len(authors))
+	for _, id := range authors {
+		ids = append(ids, int32(id))
+	}
+	rows, err := tx.QueryContext(ctx, `
+		SELECT author_id, pay_type, scanned_block_height, blockchain_height, synced
+		FROM accepted_payments
+		WHERE author_id = ANY($1) AND synced IS NOT NULL AND retired IS NULL
+		ORDER BY id;
+	`, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	syncs := make(map[int][]*SyncStatus)
+	for rows.Next() {
+		var (
+			author  int
+			payType string
+			s       SyncStatus
+		)
+		if err := rows.Scan(&author, &payType, &s.Scanned, &s.ChainHeight, &s.Synced); err != nil {
+			return nil, err
+		}
+		if s.Currency = currency.ForPayType(payType); s.Currency == nil {
+			continue
+		}
+		syncs[author] = append(syncs[author], &s)
+	}
+	return syncs, rows.Err()
+}
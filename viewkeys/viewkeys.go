@@ -0,0 +1,234 @@
+// Package viewkeys encrypts the private view keys stored in
+// accepted_payments. Every view key is encrypted with a data key of its own,
+// which is sealed to a public key. The web server only needs the public key
+// to store view keys, only the scanners hold the private keys to read them.
+package viewkeys
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	prefix = "sealed1:"
+
+	// PublicKeyEnv holds the public key view keys are sealed to
+	PublicKeyEnv = "GEMMIT_VIEW_KEY_PUBLIC"
+	// KeyringEnv holds the private keys, when no keyring file is given
+	KeyringEnv = "GEMMIT_VIEW_KEYS"
+)
+
+var ErrNoKey = errors.New("No private key for this view key")
+
+type PublicKey [32]byte
+
+// ID names the key in sealed view keys, so the right private key can be
+// picked after a rotation
+func (p *PublicKey) ID() string {
+	return hex.EncodeToString(p[:4])
+}
+
+func (p *PublicKey) String() string {
+	return hex.EncodeToString(p[:])
+}
+
+func ParsePublicKey(s string) (*PublicKey, error) {
+	b, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != 32 {
+		return nil, errors.New("Invalid view key public key")
+	}
+	var p PublicKey
+	copy(p[:], b)
+	return &p, nil
+}
+
+// LoadPublicKey reads the public key from the environment, nil if there is
+// none and view keys are stored as they are
+func LoadPublicKey() (*PublicKey, error) {
+	s := os.Getenv(PublicKeyEnv)
+	if s == "" {
+		return nil, nil
+	}
+	return ParsePublicKey(s)
+}
+
+type privateKey struct {
+	public  PublicKey
+	private [32]byte
+}
+
+// Keyring holds the private keys view keys may be sealed to, the first one
+// is the current key, the others are kept until everything was re-sealed
+type Keyring struct {
+	keys []*privateKey
+}
+
+// GenerateKey makes a new key pair, hex encoded
+func GenerateKey() (public, private string, err error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(pub[:]), hex.EncodeToString(priv[:]), nil
+}
+
+// ParseKeyring reads hex encoded private keys separated by white space,
+// lines starting with # are ignored
+func ParseKeyring(r io.Reader) (*Keyring, error) {
+	k := &Keyring{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, field := range strings.Fields(line) {
+			b, err := hex.DecodeString(field)
+			if err != nil || len(b) != 32 {
+				return nil, errors.New("Invalid view key private key")
+			}
+			key := &privateKey{}
+			copy(key.private[:], b)
+			curve25519.ScalarBaseMult((*[32]byte)(&key.public), &key.private)
+			k.keys = append(k.keys, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// LoadKeyring reads the private keys from a file, or from the environment
+// if path is empty. The keyring is empty if there are none.
+func LoadKeyring(path string) (*Keyring, error) {
+	if path == "" {
+		return ParseKeyring(strings.NewReader(os.Getenv(KeyringEnv)))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseKeyring(f)
+}
+
+// Current is the public key view keys are sealed to, nil if the keyring is
+// empty
+func (k *Keyring) Current() *PublicKey {
+	if len(k.keys) == 0 {
+		return nil
+	}
+	return &k.keys[0].public
+}
+
+func (k *Keyring) key(id string) *privateKey {
+	for _, key := range k.keys {
+		if key.public.ID() == id {
+			return key
+		}
+	}
+	return nil
+}
+
+// Sealed tells if a stored view key is encrypted, older rows may not be
+func Sealed(stored string) bool {
+	return strings.HasPrefix(stored, prefix)
+}
+
+// Seal encrypts a view key to be stored. Empty view keys stay empty.
+func Seal(to *PublicKey, viewKey string) (string, error) {
+	if viewKey == "" {
+		return "", nil
+	}
+	var dataKey [32]byte
+	if _, err := rand.Read(dataKey[:]); err != nil {
+		return "", err
+	}
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+	ciphertext := secretbox.Seal(nonce[:], []byte(viewKey), &nonce, &dataKey)
+	return wrap(to, &dataKey, ciphertext)
+}
+
+func wrap(to *PublicKey, dataKey *[32]byte, ciphertext []byte) (string, error) {
+	sealedKey, err := box.SealAnonymous(nil, dataKey[:], (*[32]byte)(to), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return prefix + to.ID() + ":" +
+		base64.RawStdEncoding.EncodeToString(sealedKey) + ":" +
+		base64.RawStdEncoding.EncodeToString(ciphertext), nil
+}
+
+// unwrap opens the data key of a sealed view key
+func (k *Keyring) unwrap(stored string) (*[32]byte, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(stored, prefix), ":")
+	if len(parts) != 3 {
+		return nil, nil, errors.New("Malformed sealed view key")
+	}
+	key := k.key(parts[0])
+	if key == nil {
+		return nil, nil, fmt.Errorf("%w, it was sealed to %s", ErrNoKey, parts[0])
+	}
+	sealedKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, errors.New("Malformed sealed view key")
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil || len(ciphertext) < 24 {
+		return nil, nil, errors.New("Malformed sealed view key")
+	}
+	b, ok := box.OpenAnonymous(nil, sealedKey, (*[32]byte)(&key.public), &key.private)
+	if !ok || len(b) != 32 {
+		return nil, nil, errors.New("Sealed view key doesn't open")
+	}
+	var dataKey [32]byte
+	copy(dataKey[:], b)
+	return &dataKey, ciphertext, nil
+}
+
+// Open decrypts a stored view key. View keys stored before they were
+// encrypted are returned as they are.
+func (k *Keyring) Open(stored string) (string, error) {
+	if !Sealed(stored) {
+		return stored, nil
+	}
+	dataKey, ciphertext, err := k.unwrap(stored)
+	if err != nil {
+		return "", err
+	}
+	var nonce [24]byte
+	copy(nonce[:], ciphertext[:24])
+	viewKey, ok := secretbox.Open(nil, ciphertext[24:], &nonce, dataKey)
+	if !ok {
+		return "", errors.New("Sealed view key doesn't open")
+	}
+	return string(viewKey), nil
+}
+
+// Reseal seals a stored view key to another public key. Only the data key
+// is sealed again, view keys which aren't sealed yet get encrypted.
+func (k *Keyring) Reseal(stored string, to *PublicKey) (string, error) {
+	if !Sealed(stored) {
+		return Seal(to, stored)
+	}
+	dataKey, ciphertext, err := k.unwrap(stored)
+	if err != nil {
+		return "", err
+	}
+	return wrap(to, dataKey, ciphertext)
+}
@@ -0,0 +1,144 @@
+package votes
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Payment is an incoming transaction to one of an author's accepted payments
+type Payment struct {
+	AcceptedPaymentID int
+	Address           string
+	TxID              string
+	Date              time.Time
+	Amount            uint64 // atomic units
+	Height            uint64 // 0 while in the mempool
+	EntryID           int    // 0 unless paid to an address published for a single entry
+}
+
+// Record stores a payment. A transaction is only ever counted once per
+// accepted payment, recording it again updates the existing row, so
+// rescanning is always safe.
+func Record(ctx context.Context, tx pgx.Tx, p *Payment) error {
+	if err := unpend(ctx, tx, p); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, `
+		INSERT INTO payments (
+			address, tx_id, tx_date, amount, height, entry_id, accepted_payments_id
+		) VALUES ($1, $2, $3, $4, $5, NULLIF($6, 0), $7)
+		ON CONFLICT ON CONSTRAINT payments_accepted_payments_id_tx_id_key
+		DO UPDATE SET
+			(address, tx_date, amount, height, entry_id) =
+			(EXCLUDED.address, EXCLUDED.tx_date, EXCLUDED.amount, EXCLUDED.height, EXCLUDED.entry_id);
+	`, p.Address, p.TxID, p.Date, p.Amount, p.Height, p.EntryID, p.AcceptedPaymentID)
+	return err
+}
+
+// RecordPending stores a transaction that isn't confirmed yet. Pending
+// payments are shown but never counted.
+func RecordPending(ctx context.Context, tx pgx.Tx, p *Payment) error {
+	var height *uint64
+	if p.Height > 0 {
+		height = &p.Height
+	}
+	_, err := tx.Exec(ctx, `
+		INSERT INTO pending_payments (
+			address, tx_id, tx_date, amount, height, entry_id, accepted_payments_id
+		) VALUES ($1, $2, $3, $4, $5, NULLIF($6, 0), $7)
+		ON CONFLICT ON CONSTRAINT pending_payments_accepted_payments_id_tx_id_key
+		DO UPDATE SET
+			(address, tx_date, amount, height, entry_id) =
+			(EXCLUDED.address, EXCLUDED.tx_date, EXCLUDED.amount, EXCLUDED.height, EXCLUDED.entry_id);
+	`, p.Address, p.TxID, p.Date, p.Amount, height, p.EntryID, p.AcceptedPaymentID)
+	return err
+}
+
+// ClearPending forgets all pending payments of an accepted payment, scanners
+// clear them before every scan so transactions that vanished from the
+// mempool or were reorganised away disappear
+func ClearPending(ctx context.Context, tx pgx.Tx, acceptedPaymentID int) error {
+	_, err := tx.Exec(ctx, `
+		DELETE FROM pending_payments WHERE accepted_payments_id = $1;
+	`, acceptedPaymentID)
+	return err
+}
+
+// Remove deletes a recorded payment, if there is one
+func Remove(ctx context.Context, tx pgx.Tx, p *Payment) error {
+	if err := unpend(ctx, tx, p); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, `
+		DELETE FROM payments
+		WHERE accepted_payments_id = $1 AND tx_id = $2;
+	`, p.AcceptedPaymentID, p.TxID)
+	return err
+}
+
+// Vanished removes the payments of an accepted payment between two heights
+// which are not among the transactions the chain still has at those heights
+func Vanished(ctx context.Context, tx pgx.Tx, acceptedPaymentID int, from, to uint64, txIDs []string) error {
+	if txIDs == nil {
+		// a NULL array would match nothing rather than everything
+		txIDs = []string{}
+	}
+	_, err := tx.Exec(ctx, `
+		DELETE FROM payments
+		WHERE accepted_payments_id = $1 AND height BETWEEN $2 AND $3
+			AND NOT (tx_id = ANY($4));
+	`, acceptedPaymentID, from, to, txIDs)
+	return err
+}
+
+// Synced records how far votes to an accepted payment were looked for, out
+// of how many blocks there were at the time
+func Synced(ctx context.Context, tx pgx.Tx, acceptedPaymentID int, scanned, chainHeight uint64) error {
+	_, err := tx.Exec(ctx, `
+		UPDATE accepted_payments
+		SET scanned_block_height = $2, blockchain_height = $3, synced = $4
+		WHERE id = $1;
+	`, acceptedPaymentID, scanned, chainHeight, time.Now().UTC())
+	return err
+}
+
+func unpend(ctx context.Context, tx pgx.Tx, p *Payment) error {
+	_, err := tx.Exec(ctx, `
+		DELETE FROM pending_payments
+		WHERE accepted_payments_id = $1 AND tx_id = $2;
+	`, p.AcceptedPaymentID, p.TxID)
+	return err
+}
+
+// EntryAddresses lists the addresses published for votes on single entries
+// of the feeds belonging to an accepted payment's author
+func EntryAddresses(ctx context.Context, q interface {
+	Query(context.Context, string, ...interface{}) (pgx.Rows, error)
+}, acceptedPaymentID int) (map[string]int, error) {
+	rows, err := q.Query(ctx, `
+		SELECT e.id, e.pay_address
+		FROM entries e
+		INNER JOIN feeds f ON e.feed_id = f.id
+		INNER JOIN accepted_payments ap ON ap.author_id = f.author_id
+		WHERE ap.id = $1 AND e.pay_address IS NOT NULL;
+	`, acceptedPaymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addresses := make(map[string]int)
+	for rows.Next() {
+		var (
+			id      int
+			address string
+		)
+		if err := rows.Scan(&id, &address); err != nil {
+			return nil, err
+		}
+		addresses[address] = id
+	}
+	return addresses, rows.Err()
+}
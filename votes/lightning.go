@@ -0,0 +1,106 @@
+package votes
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Invoice is a Lightning invoice issued to a voter through the author's
+// LNURL-pay endpoint. Settled invoices are unverified votes, they're never
+// recorded as payments, see SettleInvoice.
+type Invoice struct {
+	ID                int
+	AcceptedPaymentID int
+	FeedID            int
+	Feed              string // title, for display
+	Address           string // the author's LNURL or Lightning address
+	PaymentHash       string
+	PR                string
+	Amount            uint64 // satoshi
+	Verify            string
+	Created           time.Time
+	Expires           time.Time
+	Settled           *time.Time
+}
+
+// RecordInvoice stores an invoice that was just handed to a voter
+func RecordInvoice(ctx context.Context, tx pgx.Tx, inv *Invoice) error {
+	row := tx.QueryRow(ctx, `
+		INSERT INTO lightning_invoices (
+			payment_hash, invoice, amount, verify_url, created, expires,
+			feed_id, accepted_payments_id
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id;
+	`, inv.PaymentHash, inv.PR, inv.Amount, inv.Verify, inv.Created, inv.Expires,
+		inv.FeedID, inv.AcceptedPaymentID)
+	return row.Scan(&inv.ID)
+}
+
+const invoiceColumns = `
+	i.id, i.accepted_payments_id, i.feed_id, COALESCE(f.title, ''), ap.address,
+	i.payment_hash, i.invoice, i.amount, i.verify_url, i.created, i.expires, i.settled
+	FROM lightning_invoices i
+	INNER JOIN accepted_payments ap ON i.accepted_payments_id = ap.id
+	INNER JOIN feeds f ON i.feed_id = f.id`
+
+func scanInvoice(row pgx.Row) (*Invoice, error) {
+	var inv Invoice
+	if err := row.Scan(&inv.ID, &inv.AcceptedPaymentID, &inv.FeedID, &inv.Feed,
+		&inv.Address, &inv.PaymentHash, &inv.PR, &inv.Amount, &inv.Verify,
+		&inv.Created, &inv.Expires, &inv.Settled); err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// LoadInvoice returns the invoice with paymentHash, pgx.ErrNoRows if there
+// is none
+func LoadInvoice(ctx context.Context, q interface {
+	QueryRow(context.Context, string, ...interface{}) pgx.Row
+}, paymentHash string) (*Invoice, error) {
+	return scanInvoice(q.QueryRow(ctx, `SELECT `+invoiceColumns+`
+		WHERE i.payment_hash = $1;
+	`, paymentHash))
+}
+
+// OpenInvoices lists the unsettled invoices that can still be verified,
+// those that expired before since are given up on
+func OpenInvoices(ctx context.Context, q interface {
+	Query(context.Context, string, ...interface{}) (pgx.Rows, error)
+}, since time.Time) ([]*Invoice, error) {
+	rows, err := q.Query(ctx, `SELECT `+invoiceColumns+`
+		WHERE i.settled IS NULL AND i.verify_url <> '' AND i.expires > $1;
+	`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invoices []*Invoice
+	for rows.Next() {
+		inv, err := scanInvoice(rows)
+		if err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, inv)
+	}
+	return invoices, rows.Err()
+}
+
+// SettleInvoice marks an invoice paid. The author's own server issued the
+// invoice, so it knows the preimage and says what it likes about the
+// payment: an author could settle invoices nobody paid and vote for
+// themselves for free. Settled invoices are therefore only kept as
+// unverified votes, they aren't recorded as payments and never count
+// towards scores or rankings.
+func SettleInvoice(ctx context.Context, tx pgx.Tx, inv *Invoice, settled time.Time) error {
+	if _, err := tx.Exec(ctx, `
+		UPDATE lightning_invoices SET settled=$2 WHERE id = $1
+	`, inv.ID, settled); err != nil {
+		return err
+	}
+	inv.Settled = &settled
+	return nil
+}
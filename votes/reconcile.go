@@ -0,0 +1,154 @@
+package votes
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Discrepancy is a difference between the recorded payments of an account
+// and what a fresh scan of the chain says they should be
+type Discrepancy struct {
+	Kind    string // missing, extra, mismatched or duplicate
+	TxID    string
+	Stored  *Payment  // nil if missing
+	Scanned *Incoming // nil if the transaction is gone from the chain
+	Reason  string
+}
+
+func (d *Discrepancy) String() string {
+	s := d.Kind + " " + d.TxID
+	if d.Reason != "" {
+		s += ": " + d.Reason
+	}
+	return s
+}
+
+// Scope is which of the payments of an account a rescan can tell
+type Scope int
+
+const (
+	// AllPayments are found scanning the chain with the view key and the
+	// addresses of the entries, as scanmonero does
+	AllPayments Scope = iota
+	// MainAddressPayments are all a light wallet server finds, it doesn't
+	// know subaddresses. Payments recorded for an entry and the
+	// transactions found for one are left alone.
+	MainAddressPayments
+)
+
+// Reconcile compares the payments recorded for an account from height from
+// on with the transactions a rescan found, within what the rescan can tell.
+// Transactions without enough confirmations are left to the next scan.
+func (r *Rules) Reconcile(ctx context.Context, tx pgx.Tx, acceptedPaymentID int, from uint64,
+	scanned []*Incoming, chainHeight uint64, scope Scope) ([]*Discrepancy, error) {
+	stored := make(map[string]*Payment)
+	rows, err := tx.Query(ctx, `
+		SELECT address, tx_id, tx_date, amount, COALESCE(height, 0), COALESCE(entry_id, 0)
+		FROM payments
+		WHERE accepted_payments_id = $1 AND (height IS NULL OR height >= $2);
+	`, acceptedPaymentID, from)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		p := &Payment{AcceptedPaymentID: acceptedPaymentID}
+		if err := rows.Scan(&p.Address, &p.TxID, &p.Date, &p.Amount, &p.Height, &p.EntryID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stored[p.TxID] = p
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	skipped := make(map[string]bool)
+	if scope == MainAddressPayments {
+		for txID, p := range stored {
+			if p.EntryID != 0 {
+				skipped[txID] = true
+				delete(stored, txID)
+			}
+		}
+	}
+
+	// a counted transaction is never also pending or rejected
+	duplicates := make(map[string]string)
+	rows, err = tx.Query(ctx, `
+		SELECT p.tx_id, 'also pending' FROM payments p
+		INNER JOIN pending_payments pp
+			ON pp.accepted_payments_id = p.accepted_payments_id AND pp.tx_id = p.tx_id
+		WHERE p.accepted_payments_id = $1
+		UNION ALL
+		SELECT p.tx_id, 'also rejected' FROM payments p
+		INNER JOIN rejected_payments rp
+			ON rp.accepted_payments_id = p.accepted_payments_id AND rp.tx_id = p.tx_id
+		WHERE p.accepted_payments_id = $1;
+	`, acceptedPaymentID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var txID, reason string
+		if err := rows.Scan(&txID, &reason); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		duplicates[txID] = reason
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var found []*Discrepancy
+	seen := make(map[string]bool)
+	for _, in := range scanned {
+		if in.Height == 0 || in.Height < from {
+			continue
+		}
+		if scope == MainAddressPayments && (in.EntryID != 0 || skipped[in.TxID]) {
+			continue
+		}
+		seen[in.TxID] = true
+		p := stored[in.TxID]
+		verdict, reason := r.Check(in, chainHeight)
+		switch verdict {
+		case Accept:
+			want := in.Payment
+			want.Amount -= r.net(in)
+			if p == nil {
+				found = append(found, &Discrepancy{Kind: "missing", TxID: in.TxID, Scanned: in})
+			} else if p.Amount != want.Amount || p.Height != want.Height || p.EntryID != want.EntryID {
+				found = append(found, &Discrepancy{Kind: "mismatched", TxID: in.TxID, Stored: p, Scanned: in,
+					Reason: fmt.Sprintf("recorded %d at height %d for entry %d, scanned %d at height %d for entry %d",
+						p.Amount, p.Height, p.EntryID, want.Amount, want.Height, want.EntryID)})
+			} else if reason, ok := duplicates[in.TxID]; ok {
+				found = append(found, &Discrepancy{Kind: "duplicate", TxID: in.TxID, Stored: p, Scanned: in, Reason: reason})
+			}
+		case Reject:
+			if p != nil {
+				found = append(found, &Discrepancy{Kind: "extra", TxID: in.TxID, Stored: p, Scanned: in, Reason: reason})
+			}
+		}
+	}
+	for txID, p := range stored {
+		if !seen[txID] {
+			found = append(found, &Discrepancy{Kind: "extra", TxID: txID, Stored: p,
+				Reason: "not in the chain"})
+		}
+	}
+	return found, nil
+}
+
+// Repair makes the recorded payments match the rescan
+func (r *Rules) Repair(ctx context.Context, tx pgx.Tx, d *Discrepancy, chainHeight uint64) error {
+	if d.Scanned == nil {
+		return Remove(ctx, tx, d.Stored)
+	}
+	// applying the rules again records the transaction the way a scan would
+	_, err := r.Apply(ctx, tx, d.Scanned, chainHeight)
+	return err
+}
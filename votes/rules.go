@@ -0,0 +1,209 @@
+package votes
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/t-900-a/gemmit/currency"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// unlock times below this are block heights, above it unix timestamps
+const maxBlockNumber = 500000000
+
+// Incoming is everything a scanner knows about a transaction to an
+// accepted payment before deciding whether it counts as a vote
+type Incoming struct {
+	Payment    // Amount is the total received
+	Sent       uint64
+	Coinbase   bool
+	UnlockTime uint64
+}
+
+type Verdict int
+
+const (
+	Accept Verdict = iota
+	// Defer means the transaction may still become a vote once it has
+	// enough confirmations, it is recorded as pending until then
+	Defer
+	Reject
+)
+
+// Rules decide which incoming transactions are votes
+type Rules struct {
+	MinAmount     uint64 // atomic units, after subtracting anything sent
+	AllowCoinbase bool
+	// CountSent counts the full amount received even when the transaction
+	// also spends from the account, i.e. change from the author's own spends
+	CountSent bool
+	// UnlockWindow is how many blocks past its own height a transaction may
+	// be locked before it is no longer considered a vote
+	UnlockWindow  uint64
+	BlockTime     time.Duration
+	Confirmations uint64
+	// ReorgDepth is how many blocks below the last scanned height are
+	// checked again for transactions that were reorganised away
+	ReorgDepth uint64
+
+	minAmount string // as given on the command line, until SetCurrency
+}
+
+// Flags registers the rules on fs. Amounts are given in display units, the
+// currency may depend on other flags so they're only converted by
+// SetCurrency after parsing.
+func (r *Rules) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&r.minAmount, "min-amount", "",
+		"smallest amount counted as a vote, e.g. 0.001")
+	fs.BoolVar(&r.AllowCoinbase, "allow-coinbase", r.AllowCoinbase,
+		"count mining rewards as votes, whatever their unlock time")
+	fs.BoolVar(&r.CountSent, "count-sent", r.CountSent,
+		"count the amount received without subtracting the amount sent")
+	fs.Uint64Var(&r.UnlockWindow, "unlock-window", r.UnlockWindow,
+		"blocks a transaction may be locked for and still count as a vote")
+	fs.Uint64Var(&r.Confirmations, "confirmations", r.Confirmations,
+		"confirmations before a transaction counts as a vote")
+	fs.Uint64Var(&r.ReorgDepth, "reorg-depth", r.ReorgDepth,
+		"blocks checked again for reorganised transactions")
+}
+
+// Check decides on a transaction, chainHeight being the number of blocks
+// in the chain. The reason is set for transactions that are rejected, or
+// would be once confirmed.
+func (r *Rules) Check(in *Incoming, chainHeight uint64) (Verdict, string) {
+	reason := r.reject(in, chainHeight)
+	if in.Height == 0 || in.Height+r.Confirmations > chainHeight {
+		return Defer, reason
+	}
+	if reason != "" {
+		return Reject, reason
+	}
+	return Accept, ""
+}
+
+func (r *Rules) reject(in *Incoming, chainHeight uint64) string {
+	height := in.Height
+	if height == 0 {
+		height = chainHeight
+	}
+	if in.Coinbase && !r.AllowCoinbase {
+		return "coinbase"
+	}
+	if !r.CountSent && in.Sent >= in.Amount {
+		return "outgoing"
+	}
+	if in.Amount-r.net(in) < r.MinAmount {
+		return "below minimum amount"
+	}
+	// mining rewards are always locked for a while, 60 blocks on Monero,
+	// when they are allowed the unlock window doesn't apply to them
+	if in.Coinbase {
+		return ""
+	}
+	if in.UnlockTime < maxBlockNumber {
+		if in.UnlockTime > height+r.UnlockWindow {
+			return "locked"
+		}
+	} else {
+		window := time.Duration(r.UnlockWindow) * r.BlockTime
+		if time.Unix(int64(in.UnlockTime), 0).After(in.Date.Add(window)) {
+			return "locked"
+		}
+	}
+	return ""
+}
+
+func (r *Rules) net(in *Incoming) uint64 {
+	if r.CountSent {
+		return 0
+	}
+	return in.Sent
+}
+
+// Apply checks a transaction and records it as either a payment or a
+// rejection. Whichever it is replaces the other, so rescanning with
+// different rules leaves a consistent ledger.
+func (r *Rules) Apply(ctx context.Context, tx pgx.Tx, in *Incoming, chainHeight uint64) (Verdict, error) {
+	verdict, reason := r.Check(in, chainHeight)
+	switch verdict {
+	case Accept:
+		p := in.Payment
+		p.Amount -= r.net(in)
+		if err := unreject(ctx, tx, &p); err != nil {
+			return verdict, err
+		}
+		return verdict, Record(ctx, tx, &p)
+	case Reject:
+		if err := Remove(ctx, tx, &in.Payment); err != nil {
+			return verdict, err
+		}
+		return verdict, reject(ctx, tx, &in.Payment, reason)
+	case Defer:
+		if reason != "" {
+			// it won't count once confirmed either, don't show it
+			return verdict, nil
+		}
+		p := in.Payment
+		p.Amount -= r.net(in)
+		return verdict, RecordPending(ctx, tx, &p)
+	}
+	return verdict, nil
+}
+
+func reject(ctx context.Context, tx pgx.Tx, p *Payment, reason string) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO rejected_payments (
+			address, tx_id, tx_date, amount, reason, accepted_payments_id
+		) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT ON CONSTRAINT rejected_payments_accepted_payments_id_tx_id_key
+		DO UPDATE SET
+			(address, tx_date, amount, reason) =
+			(EXCLUDED.address, EXCLUDED.tx_date, EXCLUDED.amount, EXCLUDED.reason);
+	`, p.Address, p.TxID, p.Date, p.Amount, reason, p.AcceptedPaymentID)
+	return err
+}
+
+func unreject(ctx context.Context, tx pgx.Tx, p *Payment) error {
+	_, err := tx.Exec(ctx, `
+		DELETE FROM rejected_payments
+		WHERE accepted_payments_id = $1 AND tx_id = $2;
+	`, p.AcceptedPaymentID, p.TxID)
+	return err
+}
+
+// SetCurrency converts the amounts given as flags into atomic units of c
+func (r *Rules) SetCurrency(c *currency.Currency) error {
+	if r.minAmount == "" {
+		return nil
+	}
+	n, err := c.Parse(r.minAmount)
+	if err != nil {
+		return fmt.Errorf("Invalid -min-amount: %v", err)
+	}
+	r.MinAmount = n
+	return nil
+}
+
+// DefaultRules only count confirmed, unlocked transactions from others
+func DefaultRules(blockTime time.Duration) *Rules {
+	return &Rules{
+		UnlockWindow:  10,
+		BlockTime:     blockTime,
+		Confirmations: 10,
+		ReorgDepth:    30,
+	}
+}
+
+func (v Verdict) String() string {
+	switch v {
+	case Accept:
+		return "accepted"
+	case Defer:
+		return "deferred"
+	default:
+		return "rejected"
+	}
+}